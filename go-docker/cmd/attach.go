@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+)
+
+// attach 客户端发往 shim 的帧类型，shim 发回的是原始终端输出，不分帧
+const (
+	attachFrameHello  = 0 // 首帧，JSON 格式的 attachHello
+	attachFrameStdin  = 1 // 终端输入
+	attachFrameResize = 2 // 终端窗口大小，4 字节：行数、列数，均为大端 uint16
+)
+
+type attachHello struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// 帧格式：1 字节类型 + 4 字节大端长度 + 数据
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	hdr := make([]byte, 5)
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("attach 帧过大: %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+func encodeWinsize(ws *pty.Winsize) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, ws.Rows)
+	binary.BigEndian.PutUint16(b[2:], ws.Cols)
+	return b
+}
+
+func decodeWinsize(b []byte) (*pty.Winsize, bool) {
+	if len(b) != 4 {
+		return nil, false
+	}
+	return &pty.Winsize{Rows: binary.BigEndian.Uint16(b), Cols: binary.BigEndian.Uint16(b[2:])}, true
+}
+
+// 容器 attach socket 路径，由 shim 监听
+func containerSockPath(id string) string {
+	return containerPath(id) + ".sock"
+}
+
+// shim 侧：把 pty 输出广播给所有 attach 的客户端
+type attachHub struct {
+	mu      sync.Mutex
+	clients map[net.Conn]chan []byte
+}
+
+func newAttachHub() *attachHub {
+	return &attachHub{clients: map[net.Conn]chan []byte{}}
+}
+
+// 实现 io.Writer，不会返回错误，跟不上输出的客户端直接断开，不阻塞容器输出
+func (h *attachHub) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn, ch := range h.clients {
+		select {
+		case ch <- append([]byte(nil), p...):
+		default:
+			h.removeLocked(conn)
+		}
+	}
+	return len(p), nil
+}
+
+func (h *attachHub) add(conn net.Conn) {
+	ch := make(chan []byte, 256)
+	h.mu.Lock()
+	h.clients[conn] = ch
+	h.mu.Unlock()
+	// 写入失败说明客户端已断开，立即移出并关闭连接，handle 中阻塞的读取也随之返回
+	go func() {
+		for b := range ch {
+			if _, err := conn.Write(b); err != nil {
+				h.remove(conn)
+				break
+			}
+		}
+		conn.Close()
+	}()
+}
+
+func (h *attachHub) remove(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(conn)
+}
+
+func (h *attachHub) removeLocked(conn net.Conn) {
+	if ch, ok := h.clients[conn]; ok {
+		close(ch)
+		delete(h.clients, conn)
+	}
+}
+
+// 容器退出时断开所有客户端，已缓存的输出发送完后关闭连接
+func (h *attachHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for conn := range h.clients {
+		h.removeLocked(conn)
+	}
+}
+
+// 监听 attach socket，客户端的输入写入容器的标准输入。
+// stdin 为 nil 表示容器没有 -i，resize 为 nil 表示容器没有 pty
+func (h *attachHub) serve(l net.Listener, stdin io.Writer, resize func(*pty.Winsize)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go h.handle(conn, stdin, resize)
+	}
+}
+
+func (h *attachHub) handle(conn net.Conn, stdin io.Writer, resize func(*pty.Winsize)) {
+	typ, payload, err := readFrame(conn)
+	var hello attachHello
+	if err != nil || typ != attachFrameHello || json.Unmarshal(payload, &hello) != nil {
+		conn.Close()
+		return
+	}
+	h.add(conn)
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			h.remove(conn)
+			return
+		}
+		// 只读客户端只能观看，输入和窗口大小一律忽略
+		if hello.ReadOnly {
+			continue
+		}
+		switch typ {
+		case attachFrameStdin:
+			if stdin != nil {
+				stdin.Write(payload)
+			}
+		case attachFrameResize:
+			if ws, ok := decodeWinsize(payload); ok && resize != nil {
+				resize(ws)
+			}
+		}
+	}
+}
+
+// 解析分离键，格式 ctrl-p,ctrl-q，与 Docker 的 --detach-keys 相同
+func parseDetachKeys(s string) ([]byte, error) {
+	var keys []byte
+	for _, k := range strings.Split(s, ",") {
+		if c, ok := strings.CutPrefix(strings.ToLower(k), "ctrl-"); ok && len(c) == 1 {
+			switch ch := c[0]; {
+			case ch >= 'a' && ch <= 'z':
+				keys = append(keys, ch-'a'+1)
+			case ch == '@':
+				keys = append(keys, 0)
+			case ch >= '[' && ch <= '_':
+				keys = append(keys, ch-'['+27)
+			default:
+				return nil, fmt.Errorf("无效的分离键: %s", k)
+			}
+			continue
+		}
+		if len(k) != 1 {
+			return nil, fmt.Errorf("无效的分离键: %s", k)
+		}
+		keys = append(keys, k[0])
+	}
+	return keys, nil
+}
+
+// 在输入流中识别分离键序列。部分匹配的字节先扣下，匹配失败时再原样放出
+type detachFilter struct {
+	keys    []byte
+	matched int
+}
+
+func (d *detachFilter) filter(p []byte) ([]byte, bool) {
+	var out []byte
+	for _, b := range p {
+		if b == d.keys[d.matched] {
+			d.matched++
+			if d.matched == len(d.keys) {
+				return out, true
+			}
+			continue
+		}
+		out = append(out, d.keys[:d.matched]...)
+		d.matched = 0
+		if b == d.keys[0] {
+			d.matched = 1
+			if len(d.keys) == 1 {
+				return out, true
+			}
+			continue
+		}
+		out = append(out, b)
+	}
+	return out, false
+}
+
+// attach: 连接后台容器的终端，按分离键退出而不停止容器
+func Attach(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+	detachKeys := fs.String("detach-keys", "ctrl-p,ctrl-q", "分离终端的按键序列")
+	noStdin := fs.Bool("no-stdin", false, "只读观看，不转发输入")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		panic("attach 需要容器id")
+	}
+	keys, err := parseDetachKeys(*detachKeys)
+	must(err)
+	id, err := FindContainerID(fs.Arg(0))
+	must(err)
+	if !containerRunning(id) {
+		panic("容器未运行: " + id)
+	}
+	conn, err := net.Dial("unix", containerSockPath(id))
+	if err != nil {
+		panic(fmt.Sprintf("连接容器 %s 失败（只有后台运行的容器可以 attach）: %v", id, err))
+	}
+	defer conn.Close()
+	hello, _ := json.Marshal(attachHello{ReadOnly: *noStdin})
+	must(writeFrame(conn, attachFrameHello, hello))
+
+	detached := make(chan struct{})
+	restore := func() {}
+	if !*noStdin {
+		// 连接后先同步一次窗口大小，之后随 SIGWINCH 转发
+		if ws := terminalSize(); ws != nil {
+			writeFrame(conn, attachFrameResize, encodeWinsize(ws))
+		}
+		defer watchResize(func(ws *pty.Winsize) {
+			writeFrame(conn, attachFrameResize, encodeWinsize(ws))
+		})()
+		// raw 模式下分离键等按键才能逐个读到
+		if r, err := makeRaw(os.Stdin); err == nil {
+			restore = r
+			defer restore()
+		}
+		go func() {
+			filter := &detachFilter{keys: keys}
+			buf := make([]byte, 1024)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if n > 0 {
+					out, detach := filter.filter(buf[:n])
+					if len(out) > 0 {
+						if writeFrame(conn, attachFrameStdin, out) != nil {
+							return
+						}
+					}
+					if detach {
+						close(detached)
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(outputDone)
+	}()
+	select {
+	case <-outputDone:
+	case <-detached:
+		restore()
+		fmt.Printf("\n已从容器 %s 分离，容器继续在后台运行\n", id)
+	}
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 能力名称，下标即能力编号
+var capNames = []string{
+	"CHOWN", "DAC_OVERRIDE", "DAC_READ_SEARCH", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID",
+	"SETPCAP", "LINUX_IMMUTABLE", "NET_BIND_SERVICE", "NET_BROADCAST", "NET_ADMIN", "NET_RAW",
+	"IPC_LOCK", "IPC_OWNER", "SYS_MODULE", "SYS_RAWIO", "SYS_CHROOT", "SYS_PTRACE", "SYS_PACCT",
+	"SYS_ADMIN", "SYS_BOOT", "SYS_NICE", "SYS_RESOURCE", "SYS_TIME", "SYS_TTY_CONFIG", "MKNOD",
+	"LEASE", "AUDIT_WRITE", "AUDIT_CONTROL", "SETFCAP", "MAC_OVERRIDE", "MAC_ADMIN", "SYSLOG",
+	"WAKE_ALARM", "BLOCK_SUSPEND", "AUDIT_READ", "PERFMON", "BPF", "CHECKPOINT_RESTORE",
+}
+
+// 与 Docker 相同的默认能力集，不含 SYS_MODULE、SYS_TIME、SYS_ADMIN 等
+var defaultCaps = []string{
+	"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD", "NET_RAW", "SETGID", "SETUID",
+	"SETFCAP", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT", "KILL", "AUDIT_WRITE",
+}
+
+// 统一为不带 CAP_ 前缀的大写名称，并校验是否存在
+func normalizeCap(name string) (string, error) {
+	name = strings.TrimPrefix(strings.ToUpper(name), "CAP_")
+	if name == "ALL" {
+		return name, nil
+	}
+	for _, c := range capNames {
+		if c == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("未知的能力: %s", name)
+}
+
+// 根据 --cap-add/--cap-drop/--privileged 计算容器最终的能力集
+func resolveCaps(add, drop []string, privileged bool) ([]string, error) {
+	if privileged {
+		return append([]string(nil), capNames...), nil
+	}
+	set := map[string]bool{}
+	for _, c := range defaultCaps {
+		set[c] = true
+	}
+	for _, c := range drop {
+		c, err := normalizeCap(c)
+		if err != nil {
+			return nil, err
+		}
+		if c == "ALL" {
+			set = map[string]bool{}
+			continue
+		}
+		delete(set, c)
+	}
+	for _, c := range add {
+		c, err := normalizeCap(c)
+		if err != nil {
+			return nil, err
+		}
+		if c == "ALL" {
+			for _, n := range capNames {
+				set[n] = true
+			}
+			continue
+		}
+		set[c] = true
+	}
+	var caps []string
+	for _, c := range capNames {
+		if set[c] {
+			caps = append(caps, c)
+		}
+	}
+	return caps, nil
+}
+
+// 内核支持的最大能力编号
+func lastCapability() int {
+	lastCap := len(capNames) - 1
+	if b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			lastCap = n
+		}
+	}
+	return lastCap
+}
+
+func capIndexes(caps []string) map[int]bool {
+	keep := map[int]bool{}
+	for _, c := range caps {
+		for i, n := range capNames {
+			if n == c {
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// 在 exec 前把当前进程的能力收缩到 caps，分两步：
+// 先从 bounding 集中去掉 caps 以外的能力并清空 ambient（需要 CAP_SETPCAP，在切换用户之前调用），
+// 切换用户后再用 setCapabilities 设置 effective/permitted
+func dropBoundingCaps(caps []string) error {
+	lastCap := lastCapability()
+	keep := capIndexes(caps)
+	for i := 0; i <= lastCap; i++ {
+		if keep[i] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("从 bounding 集中删除能力 %d 失败: %v", i, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil && err != unix.EINVAL {
+		return fmt.Errorf("清空 ambient 能力失败: %v", err)
+	}
+	return nil
+}
+
+// 用 capset 设置 effective/permitted。inheritable 保持为空（CVE-2022-24769），
+// 否则非 root 用户 exec 带 inheritable 文件能力的程序时会获得这些能力
+func setCapabilities(caps []string) error {
+	lastCap := lastCapability()
+	keep := capIndexes(caps)
+	var data [2]unix.CapUserData
+	for i := range keep {
+		// 宿主机本身没有的能力（不在 bounding 集中）无法授予，跳过
+		if i > lastCap {
+			continue
+		}
+		if ok, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, uintptr(i), 0, 0, 0); err != nil || ok != 1 {
+			continue
+		}
+		data[i/32].Effective |= 1 << uint(i%32)
+		data[i/32].Permitted |= 1 << uint(i%32)
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset 失败: %v", err)
+	}
+	return nil
+}
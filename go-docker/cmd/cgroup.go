@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	cgroupParent = "godocker"
+)
+
+// 容器资源限制，对应 run 的 --memory、--cpus、--pids-limit 等参数
+type resources struct {
+	Memory         int64    `json:"memory,omitempty"`      // 字节
+	MemorySwap     int64    `json:"memory_swap,omitempty"` // 内存+swap 总量，-1 表示 swap 不限制
+	CPUs           float64  `json:"cpus,omitempty"`
+	CPUShares      int64    `json:"cpu_shares,omitempty"`
+	PidsLimit      int64    `json:"pids_limit,omitempty"`
+	CpusetCpus     string   `json:"cpuset_cpus,omitempty"`
+	CpusetMems     string   `json:"cpuset_mems,omitempty"`
+	DeviceReadBps  []string `json:"device_read_bps,omitempty"`  // /dev/sda:1mb
+	DeviceWriteBps []string `json:"device_write_bps,omitempty"` // /dev/sda:1mb
+	// 设备白名单，为空表示不限制（--privileged 或 rootless）
+	Devices []deviceRule `json:"devices,omitempty"`
+}
+
+// 是否设置了任何资源限制
+func (r resources) empty() bool {
+	return r.Memory == 0 && r.MemorySwap == 0 && r.CPUs == 0 && r.CPUShares == 0 &&
+		r.PidsLimit == 0 && r.CpusetCpus == "" && r.CpusetMems == "" &&
+		len(r.DeviceReadBps) == 0 && len(r.DeviceWriteBps) == 0 && len(r.Devices) == 0
+}
+
+const (
+	cgroupModeV2 = "v2"
+	cgroupModeV1 = "v1"
+)
+
+// 容器 cgroup 的创建、限制与清理，v2 和 v1 各有一套实现
+type cgroupManager interface {
+	Create() error
+	Apply(r resources) error
+	Destroy() error
+	// 容器内是否有进程因超出内存上限被 OOM killer 杀死
+	OOMKilled() bool
+}
+
+// 检测宿主机的 cgroup 模式：/sys/fs/cgroup 为 cgroup2 时是 unified 模式，
+// 为 tmpfs 且挂载了各控制器时是 v1（包括 hybrid 模式，控制器都在 v1 上）
+func detectCgroupMode() string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &st); err != nil {
+		return ""
+	}
+	if st.Type == unix.CGROUP2_SUPER_MAGIC {
+		return cgroupModeV2
+	}
+	for _, ctrl := range cgroupV1Controllers {
+		if err := unix.Statfs(filepath.Join(cgroupRoot, ctrl), &st); err == nil && st.Type == unix.CGROUP_SUPER_MAGIC {
+			return cgroupModeV1
+		}
+	}
+	return ""
+}
+
+func newCgroupManager(mode, id string) cgroupManager {
+	switch mode {
+	case cgroupModeV2:
+		return newCgroupV2(id)
+	case cgroupModeV1:
+		return newCgroupV1(id)
+	}
+	return nil
+}
+
+// cgroup v2 管理器，每个容器对应 /sys/fs/cgroup/godocker/<id>
+type cgroupV2 struct {
+	path string
+}
+
+func newCgroupV2(id string) *cgroupV2 {
+	return &cgroupV2{path: filepath.Join(cgroupRoot, cgroupParent, id)}
+}
+
+// 创建容器 cgroup，并在父级逐层开启需要的控制器
+func (c *cgroupV2) Create() error {
+	parent := filepath.Dir(c.path)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, ctrl := range strings.Fields(string(b)) {
+		switch ctrl {
+		case "cpu", "cpuset", "io", "memory", "pids":
+			enable = append(enable, "+"+ctrl)
+		}
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		for _, ctrl := range enable {
+			// 单个控制器开启失败（例如根 cgroup 下有进程占用）不影响其它控制器
+			_ = os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(ctrl), 0644)
+		}
+	}
+	return os.Mkdir(c.path, 0755)
+}
+
+// 写入各项资源限制
+func (c *cgroupV2) Apply(r resources) error {
+	if r.Memory > 0 {
+		if err := c.write("memory.max", strconv.FormatInt(r.Memory, 10)); err != nil {
+			return err
+		}
+	}
+	if r.MemorySwap != 0 {
+		swap := "max"
+		if r.MemorySwap > 0 {
+			// --memory-swap 是内存与 swap 的总量，memory.swap.max 只算 swap 部分
+			if r.MemorySwap < r.Memory {
+				return fmt.Errorf("--memory-swap(%d) 不能小于 --memory(%d)", r.MemorySwap, r.Memory)
+			}
+			swap = strconv.FormatInt(r.MemorySwap-r.Memory, 10)
+		}
+		if err := c.write("memory.swap.max", swap); err != nil {
+			return err
+		}
+	}
+	if r.CPUs > 0 {
+		const period = 100000
+		quota := int64(r.CPUs * period)
+		if err := c.write("cpu.max", fmt.Sprintf("%d %d", quota, period)); err != nil {
+			return err
+		}
+	}
+	if r.CPUShares > 0 {
+		// 与 runc 相同的换算：shares [2, 262144] 映射到 weight [1, 10000]
+		weight := 1 + ((r.CPUShares-2)*9999)/262142
+		if err := c.write("cpu.weight", strconv.FormatInt(weight, 10)); err != nil {
+			return err
+		}
+	}
+	if r.PidsLimit != 0 {
+		limit := "max"
+		if r.PidsLimit > 0 {
+			limit = strconv.FormatInt(r.PidsLimit, 10)
+		}
+		if err := c.write("pids.max", limit); err != nil {
+			return err
+		}
+	}
+	if r.CpusetCpus != "" {
+		if err := c.write("cpuset.cpus", r.CpusetCpus); err != nil {
+			return err
+		}
+	}
+	if r.CpusetMems != "" {
+		if err := c.write("cpuset.mems", r.CpusetMems); err != nil {
+			return err
+		}
+	}
+	for _, spec := range r.DeviceReadBps {
+		dev, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return err
+		}
+		if err := c.write("io.max", fmt.Sprintf("%s rbps=%d", dev, rate)); err != nil {
+			return err
+		}
+	}
+	for _, spec := range r.DeviceWriteBps {
+		dev, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return err
+		}
+		if err := c.write("io.max", fmt.Sprintf("%s wbps=%d", dev, rate)); err != nil {
+			return err
+		}
+	}
+	if len(r.Devices) > 0 {
+		if err := c.applyDevices(r.Devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV2) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(c.path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("写入 %s=%s 失败: %v", file, value, err)
+	}
+	return nil
+}
+
+// 打开 cgroup 目录，供 clone3(CLONE_INTO_CGROUP) 使用，子进程创建时即位于容器 cgroup 中
+func (c *cgroupV2) Open() (*os.File, error) {
+	return os.Open(c.path)
+}
+
+// 删除容器 cgroup，残留进程先通过 cgroup.kill 杀掉
+func (c *cgroupV2) Destroy() error {
+	if _, err := os.Stat(c.path); os.IsNotExist(err) {
+		return nil
+	}
+	_ = os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+	var err error
+	for i := 0; i < 50; i++ {
+		if err = unix.Rmdir(c.path); err == nil || errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("删除 cgroup %s 失败: %v", c.path, err)
+}
+
+// 解析 /dev/sda:1mb，返回 "major:minor" 和每秒字节数
+func parseDeviceRate(spec string) (string, int64, error) {
+	path, rate, ok := strings.Cut(spec, ":")
+	if !ok {
+		return "", 0, fmt.Errorf("设备限速格式错误: %s，应为 <设备>:<速率>", spec)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", 0, fmt.Errorf("读取设备 %s 失败: %v", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", 0, fmt.Errorf("%s 不是块设备", path)
+	}
+	n, err := parseBytes(rate)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev)), n, nil
+}
+
+// 解析 512m、1g、100k 这类大小，单位按 1024 换算
+func parseBytes(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "b")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		case 't':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无法解析大小: %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// memory.events 中的 oom_kill 计数
+func (c *cgroupV2) OOMKilled() bool {
+	return readKeyedStat(filepath.Join(c.path, "memory.events"), "oom_kill") > 0
+}
+
+// 读取 cgroup 中 "key value" 格式文件的某一项，读取失败时返回 0
+func readKeyedStat(path, key string) int64 {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		k, v, ok := strings.Cut(line, " ")
+		if ok && k == key {
+			n, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// 容器是否发生过 OOM kill，需在删除 cgroup 之前调用
+func containerOOMKilled(info ContainerInfo) bool {
+	cg := newCgroupManager(info.CgroupMode, info.ID)
+	return cg != nil && cg.OOMKilled()
+}
+
+// 删除容器对应的 cgroup，容器未创建 cgroup 时什么也不做
+func destroyCgroup(info ContainerInfo) {
+	cg := newCgroupManager(info.CgroupMode, info.ID)
+	if cg == nil {
+		return
+	}
+	if err := cg.Destroy(); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// v1 下各控制器是独立的层级，每个容器在每个控制器下都有一个目录
+var cgroupV1Controllers = []string{"memory", "cpu", "pids", "cpuset", "blkio", "devices"}
+
+// cgroup v1 管理器，每个容器对应 /sys/fs/cgroup/<controller>/godocker/<id>
+type cgroupV1 struct {
+	id string
+}
+
+func newCgroupV1(id string) *cgroupV1 {
+	return &cgroupV1{id: id}
+}
+
+func (c *cgroupV1) path(ctrl string) string {
+	return filepath.Join(cgroupRoot, ctrl, cgroupParent, c.id)
+}
+
+// 控制器是否已挂载
+func (c *cgroupV1) mounted(ctrl string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(filepath.Join(cgroupRoot, ctrl), &st) == nil && st.Type == unix.CGROUP_SUPER_MAGIC
+}
+
+// 在每个已挂载的控制器下创建容器目录
+func (c *cgroupV1) Create() error {
+	for _, ctrl := range cgroupV1Controllers {
+		if !c.mounted(ctrl) {
+			continue
+		}
+		dir := c.path(ctrl)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("创建 cgroup %s 失败: %v", dir, err)
+		}
+		if ctrl == "cpuset" {
+			// 新建的 cpuset 目录 cpus/mems 为空，不填就无法加入进程，从上级继承
+			for _, d := range []string{filepath.Dir(dir), dir} {
+				if err := inheritCpuset(d); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 从上级目录复制 cpuset.cpus/cpuset.mems
+func inheritCpuset(dir string) error {
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		cur, _ := os.ReadFile(filepath.Join(dir, file))
+		if strings.TrimSpace(string(cur)) != "" {
+			continue
+		}
+		parent, err := os.ReadFile(filepath.Join(filepath.Dir(dir), file))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), parent, 0644); err != nil {
+			return fmt.Errorf("初始化 %s/%s 失败: %v", dir, file, err)
+		}
+	}
+	return nil
+}
+
+// 写入各项资源限制，需要的控制器未挂载时直接报错，不静默忽略
+func (c *cgroupV1) Apply(r resources) error {
+	if r.Memory > 0 {
+		if err := c.write("memory", "memory.limit_in_bytes", strconv.FormatInt(r.Memory, 10)); err != nil {
+			return err
+		}
+	}
+	if r.MemorySwap != 0 {
+		// v1 的 memsw 本身就是内存与 swap 的总量，与 --memory-swap 含义一致
+		if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+			return fmt.Errorf("--memory-swap(%d) 不能小于 --memory(%d)", r.MemorySwap, r.Memory)
+		}
+		if _, err := os.Stat(filepath.Join(c.path("memory"), "memory.memsw.limit_in_bytes")); err != nil {
+			return fmt.Errorf("宿主机未开启 swap 记账（swapaccount=1），无法设置 --memory-swap")
+		}
+		if err := c.write("memory", "memory.memsw.limit_in_bytes", strconv.FormatInt(r.MemorySwap, 10)); err != nil {
+			return err
+		}
+	}
+	if r.CPUs > 0 {
+		const period = 100000
+		if err := c.write("cpu", "cpu.cfs_period_us", strconv.Itoa(period)); err != nil {
+			return err
+		}
+		if err := c.write("cpu", "cpu.cfs_quota_us", strconv.FormatInt(int64(r.CPUs*period), 10)); err != nil {
+			return err
+		}
+	}
+	if r.CPUShares > 0 {
+		if err := c.write("cpu", "cpu.shares", strconv.FormatInt(r.CPUShares, 10)); err != nil {
+			return err
+		}
+	}
+	if r.PidsLimit != 0 {
+		limit := "max"
+		if r.PidsLimit > 0 {
+			limit = strconv.FormatInt(r.PidsLimit, 10)
+		}
+		if err := c.write("pids", "pids.max", limit); err != nil {
+			return err
+		}
+	}
+	if r.CpusetCpus != "" {
+		if err := c.write("cpuset", "cpuset.cpus", r.CpusetCpus); err != nil {
+			return err
+		}
+	}
+	if r.CpusetMems != "" {
+		if err := c.write("cpuset", "cpuset.mems", r.CpusetMems); err != nil {
+			return err
+		}
+	}
+	for _, spec := range r.DeviceReadBps {
+		dev, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return err
+		}
+		if err := c.write("blkio", "blkio.throttle.read_bps_device", fmt.Sprintf("%s %d", dev, rate)); err != nil {
+			return err
+		}
+	}
+	for _, spec := range r.DeviceWriteBps {
+		dev, rate, err := parseDeviceRate(spec)
+		if err != nil {
+			return err
+		}
+		if err := c.write("blkio", "blkio.throttle.write_bps_device", fmt.Sprintf("%s %d", dev, rate)); err != nil {
+			return err
+		}
+	}
+	if len(r.Devices) > 0 {
+		if err := c.applyDevices(r.Devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cgroupV1) write(ctrl, file, value string) error {
+	if !c.mounted(ctrl) {
+		return fmt.Errorf("宿主机未挂载 cgroup v1 控制器 %s，无法设置 %s", ctrl, file)
+	}
+	if err := os.WriteFile(filepath.Join(c.path(ctrl), file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("写入 %s/%s=%s 失败: %v", ctrl, file, value, err)
+	}
+	return nil
+}
+
+// 把当前进程加入容器 cgroup，由 child 在 exec 前调用（v1 没有 CLONE_INTO_CGROUP）
+func (c *cgroupV1) Join() error {
+	for _, ctrl := range cgroupV1Controllers {
+		if !c.mounted(ctrl) {
+			continue
+		}
+		// 写入 0 表示当前进程，child 在新的 pid namespace 里看不到自己的宿主机 pid
+		if err := os.WriteFile(filepath.Join(c.path(ctrl), "cgroup.procs"), []byte("0"), 0644); err != nil {
+			return fmt.Errorf("加入 cgroup %s 失败: %v", c.path(ctrl), err)
+		}
+	}
+	return nil
+}
+
+// memory.oom_control 中的 oom_kill 计数（4.13 及以上内核）
+func (c *cgroupV1) OOMKilled() bool {
+	return readKeyedStat(filepath.Join(c.path("memory"), "memory.oom_control"), "oom_kill") > 0
+}
+
+// 删除各控制器下的容器目录，v1 没有 cgroup.kill，残留进程逐个杀掉
+func (c *cgroupV1) Destroy() error {
+	var lastErr error
+	for _, ctrl := range cgroupV1Controllers {
+		dir := c.path(ctrl)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "cgroup.procs")); err == nil {
+			for _, f := range strings.Fields(string(b)) {
+				if pid, err := strconv.Atoi(f); err == nil {
+					syscall.Kill(pid, syscall.SIGKILL)
+				}
+			}
+		}
+		var err error
+		for i := 0; i < 50; i++ {
+			if err = unix.Rmdir(dir); err == nil || errors.Is(err, unix.ENOENT) {
+				err = nil
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("删除 cgroup %s 失败: %v", dir, err)
+		}
+	}
+	return lastErr
+}
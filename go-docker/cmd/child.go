@@ -4,122 +4,214 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
 func Child() {
-	// 在新的namespace 运行, 真正做环境隔离
-	fmt.Printf("Running %v in child process as container\n", os.Args[2:])
-	syscall.Sethostname([]byte("container"))
+	// 能力集、seccomp 等设置只对调用线程生效，锁定线程保证它们和最后的 exec 在同一线程
+	runtime.LockOSThread()
+	// 在新的namespace 运行, 真正做环境隔离。
+	// 标准输出和标准错误已接入容器日志，这里只输出错误，不打印调试信息
+	// rootless 模式下先等待 uid/gid 映射
+	waitIDMap()
+	execSync := markExecSync()
 
 	rootfs := os.Getenv("CONTAINER_ROOTFS")
-	fmt.Printf("child: CONTAINER_ROOTFS=%s\n", rootfs)
 	if rootfs == "" {
 		rootfs = "/tmp/newroot/"
 	}
-	// chroot 前调试
-	out1, err1 := exec.Command("ls", "-l", rootfs).CombinedOutput()
-	fmt.Printf("child: chroot前 ls -l %s 输出:\n%s\nerr: %v\n", rootfs, string(out1), err1)
-	err2 := syscall.Chroot(rootfs)
-	if err2 != nil {
-		fmt.Printf("child: chroot(%s) 失败: %v\n", rootfs, err2)
-		panic(err2)
-	}
-	err3 := os.Chdir("/")
-	if err3 != nil {
-		fmt.Printf("child: chdir(/) 失败: %v\n", err3)
-		panic(err3)
-	}
-	// chroot 后调试
-	out2, err4 := exec.Command("ls", "-l", "/").CombinedOutput()
-	fmt.Printf("child: chroot后 ls -l / 输出:\n%s\nerr: %v\n", string(out2), err4)
-	// 自动创建 /dev/null 和 /dev/tty 等伪设备
-	setupDev()
-	// 挂载点设置为私有，防止影响宿主机
+	// 读取 run 写入的元数据，获取 hostname 等配置
+	info, err := loadContainerInfo(os.Getenv("CONTAINER_ID"))
+	if err != nil {
+		fmt.Printf("child: 读取容器元数据失败: %v\n", err)
+	}
+	// v1 没有 CLONE_INTO_CGROUP，由 child 自己在 exec 前加入容器 cgroup
+	// 之后再建一层 cgroup namespace，使容器 cgroup 成为 namespace 的根
+	if info.CgroupMode == cgroupModeV1 {
+		must(newCgroupV1(info.ID).Join())
+		must(unix.Unshare(unix.CLONE_NEWCGROUP))
+	}
+	// --ipc=container:<id> 加入目标容器的 IPC namespace
+	must(joinIPCNamespace(info.IPC))
+	hostname := info.Hostname
+	if hostname == "" {
+		hostname = "container"
+	}
+	must(syscall.Sethostname([]byte(hostname)))
+	// 挂载点设置为私有，防止影响宿主机（必须在任何挂载之前）
 	must(syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""))
-	// 挂载 /dev/pts，保证伪终端可用
-	os.MkdirAll("/dev/pts", 0755)
-	must(syscall.Mount("devpts", "/dev/pts", "devpts", 0, ""))
+	base := strings.TrimSuffix(info.Rootfs, "/merged")
+	// rootless 模式在 user namespace 内解包镜像层并挂载 overlay
+	if info.Rootless {
+		if singleIDMapping() {
+			// 只映射了一个 id 时无法 chown 成其它属主
+			must(extractLayer(info.Layer, base+"/lower", "--no-same-owner"))
+		} else {
+			must(extractLayer(info.Layer, base+"/lower"))
+		}
+		must(mountOverlay(base))
+	}
+	// 覆盖 /etc/hosts、/etc/hostname、/etc/resolv.conf
+	if info.ID != "" {
+		must(mountEtcFiles(rootfs, base))
+	}
+	// 全新的 tmpfs /dev
+	shmSize := info.ShmSize
+	if shmSize == 0 {
+		shmSize = defaultShmSize
+	}
+	shmFrom, err := shmSource(info)
+	must(err)
+	setupDev(rootfs, shmSize, shmFrom)
+	must(bindDevices(rootfs, info.Devices))
+	must(mountVolumes(rootfs, info.Volumes))
+	if info.Rootless {
+		bindHostSysfs(rootfs)
+	}
+	// exec 读取的环境变量文件在宿主机的状态目录中，chroot 前打开
+	var envFile *os.File
+	if info.ID != "" {
+		envFile, err = os.Create(containerPath(info.ID) + ".env")
+		must(err)
+	}
+	must(syscall.Chroot(rootfs))
+	must(os.Chdir("/"))
 	// 挂载 proc 文件系统，保证 ps/top 等命令可用
 	must(syscall.Mount("proc", "/proc", "proc", 0, ""))
+	// --time-offset 创建 time namespace，需要容器自己的 /proc 才能按线程 id 找到偏移文件
+	must(setupTimeNamespace(info.TimeOffsets))
+	// 挂载只读的 /sys 和容器自己的 cgroup 文件系统
+	// 特权容器的 /sys 和 cgroup 可写
+	if !info.Rootless {
+		mountSysfs(!info.Privileged)
+	}
+	mountCgroupfs(info.CgroupMode, !info.Privileged)
+	// --sysctl 需在 /proc/sys 设为只读之前写入
+	must(applySysctls(info.Sysctls))
+	// 屏蔽 /proc/kcore 等敏感文件，/proc/sys 等设为只读
+	if !info.Privileged {
+		maskPaths()
+		readonlyProcPaths()
+	}
+	for _, t := range info.Tmpfs {
+		must(mountTmpfs(t))
+	}
+	// -w 指定的工作目录不存在时创建，需在根目录设为只读之前
+	if info.WorkingDir != "" {
+		must(os.MkdirAll(info.WorkingDir, 0755))
+		must(os.Chdir(info.WorkingDir))
+	}
+	if info.ReadOnly {
+		must(remountRootReadonly())
+	}
+	// 在容器自己的 /etc/passwd、/etc/group 中解析 --user
+	user, err := resolveUser(info.User)
+	must(err)
+	// 容器的环境变量从头设置，不继承宿主机的环境变量
+	os.Clearenv()
 	// 设置常用环境变量，提升 shell 交互体验
 	os.Setenv("TERM", "xterm")
-	os.Setenv("HOME", "/root")
-	os.Setenv("USER", "root")
+	os.Setenv("HOME", user.Home)
+	os.Setenv("USER", user.Name)
 	os.Setenv("PATH", "/bin:/usr/bin:/sbin:/usr/sbin")
 	os.Setenv("PS1", "[container \\u@\\h \\w]# ")
 	os.Setenv("PROMPT_COMMAND", "")
 	os.Setenv("LC_ALL", "C")
 	os.Setenv("LANG", "C")
+	// -e 指定的环境变量最后设置，可覆盖上面的默认值
+	for _, kv := range info.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		os.Setenv(key, value)
+	}
 
-	// 调试：打印 tty 及设备节点信息
-	fmt.Println("child: 调试 tty 及设备节点信息")
-	out3, err5 := exec.Command("tty").CombinedOutput()
-	fmt.Printf("child: tty 命令输出: %s, err: %v\n", string(out3), err5)
-	out4, err6 := exec.Command("ls", "-l", "/dev/tty", "/dev/console", "/dev/ptmx", "/dev/pts").CombinedOutput()
-	fmt.Printf("child: ls -l /dev/tty /dev/console /dev/ptmx /dev/pts 输出:\n%s\nerr: %v\n", string(out4), err6)
-	// 新增更多文件系统调试信息
-	out5, err7 := exec.Command("ls", "-lR", "/dev").CombinedOutput()
-	fmt.Printf("child: ls -lR /dev 输出:\n%s\nerr: %v\n", string(out5), err7)
-	out6, err8 := exec.Command("mount").CombinedOutput()
-	fmt.Printf("child: mount 输出:\n%s\nerr: %v\n", string(out6), err8)
-	out7, err9 := exec.Command("cat", "/proc/mounts").CombinedOutput()
-	fmt.Printf("child: /proc/mounts 输出:\n%s\nerr: %v\n", string(out7), err9)
-	out8, err10 := exec.Command("ls", "-l", "/").CombinedOutput()
-	fmt.Printf("child: ls -l / 输出:\n%s\nerr: %v\n", string(out8), err10)
-
-	// 保存环境变量到 /tmp/container_<id>.env
-	containerID := os.Getenv("CONTAINER_ID")
-	if containerID == "" && len(os.Args) > 2 {
-		containerID = os.Args[2]
-	}
-	envFile := "/tmp/container_" + containerID + ".env"
-	f, err := os.Create(envFile)
-	if err == nil {
+	// 保存环境变量到 <状态目录>/container_<id>.env，exec 时使用
+	if envFile != nil {
 		for _, kv := range os.Environ() {
-			f.WriteString(kv + "\n")
+			envFile.WriteString(kv + "\n")
 		}
-		f.Close()
+		envFile.Close()
 	}
 	// 执行输入的命令，强制加 -i 参数提升交互性
 	cmdArgs := os.Args[2:]
 	// if len(cmdArgs) > 0 && (cmdArgs[0] == "/bin/sh" || cmdArgs[0] == "/bin/busybox") {
 	// 	cmdArgs = append(cmdArgs, "-i")
 	// }
-	must(syscall.Exec(cmdArgs[0], cmdArgs, os.Environ()))
+	// 资源限制和 oom_score_adj 需要 CAP_SYS_RESOURCE，在收缩能力集之前设置
+	must(applyUlimits(info.Ulimits))
+	if info.OOMScoreAdj != 0 {
+		must(applyOOMScoreAdj(info.OOMScoreAdj))
+	}
+	// 最后安装 seccomp 并收缩能力集，之后不再需要特权操作
+	must(dropPrivileges(info, user))
+	// 按容器的 PATH 查找命令，找不到或不可执行时以 127/126 退出
+	path, err := lookupCommand(cmdArgs[0])
+	if err != nil {
+		panic(err)
+	}
+	if info.Init {
+		runInit(path, cmdArgs, os.Environ(), info.Tty, execSync)
+	}
+	panic(execError(cmdArgs[0], syscall.Exec(path, cmdArgs, os.Environ())))
 }
 
-// 自动创建 /dev/null 和 /dev/tty 等伪设备
-func setupDev() {
-	os.MkdirAll("/dev", 0755)
-	// /dev/null
-	if _, err := os.Stat("/dev/null"); os.IsNotExist(err) {
-		syscall.Mknod("/dev/null", syscall.S_IFCHR|0666, int((1<<8)|3)) // major=1, minor=3
-	}
-	// /dev/zero
-	if _, err := os.Stat("/dev/zero"); os.IsNotExist(err) {
-		syscall.Mknod("/dev/zero", syscall.S_IFCHR|0666, int((1<<8)|5)) // major=1, minor=5
-	}
-	// /dev/tty
-	if _, err := os.Stat("/dev/tty"); os.IsNotExist(err) {
-		syscall.Mknod("/dev/tty", syscall.S_IFCHR|0666, int((5<<8)|0)) // major=5, minor=0
-	}
-	// /dev/console
-	if _, err := os.Stat("/dev/console"); os.IsNotExist(err) {
-		syscall.Mknod("/dev/console", syscall.S_IFCHR|0600, int((5<<8)|1)) // major=5, minor=1
-	}
-	// /dev/ptmx（主伪终端设备，major=5, minor=2）
-	if _, err := os.Stat("/dev/ptmx"); os.IsNotExist(err) {
-		syscall.Mknod("/dev/ptmx", syscall.S_IFCHR|0666, int((5<<8)|2))
-	}
-	// /dev/pts/ptmx 必须是符号链接到 /dev/ptmx
-	os.MkdirAll("/dev/pts", 0755)
-	ptmxLink := "/dev/pts/ptmx"
-	if _, err := os.Lstat(ptmxLink); os.IsNotExist(err) {
-		os.Symlink("/dev/ptmx", ptmxLink)
+// 容器 /dev 中从宿主机 bind 进来的标准设备
+var standardDevices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+// 在 rootfs/dev 上挂载全新的 tmpfs，bind 宿主机的标准设备，避免 mknod 写入 overlay 的 upper 层。
+// bind 而不是 mknod，rootless 模式下同样可用。需在 chroot 之前调用。
+func setupDev(rootfs string, shmSize int64, shmFrom string) {
+	dev := filepath.Join(rootfs, "dev")
+	os.MkdirAll(dev, 0755)
+	must(syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"))
+	for _, name := range standardDevices {
+		bindDevice("/dev/"+name, filepath.Join(dev, name))
+	}
+	// 控制台指向容器进程的终端（pty 从设备）
+	if tty, err := os.Readlink("/proc/self/fd/0"); err == nil && strings.HasPrefix(tty, "/dev/pts/") {
+		bindDevice(tty, filepath.Join(dev, "console"))
+	}
+	links := [][2]string{
+		{"/proc/self/fd", "fd"},
+		{"/proc/self/fd/0", "stdin"},
+		{"/proc/self/fd/1", "stdout"},
+		{"/proc/self/fd/2", "stderr"},
+		{"/proc/kcore", "core"},
+		{"pts/ptmx", "ptmx"},
+	}
+	for _, l := range links {
+		os.Symlink(l[0], filepath.Join(dev, l[1]))
+	}
+	// 独立的 devpts 实例，容器内打开的 pty 与宿主机隔离
+	pts := filepath.Join(dev, "pts")
+	os.MkdirAll(pts, 0755)
+	if err := syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"newinstance,ptmxmode=0666,mode=0620,gid=5"); err != nil {
+		// rootless 下 gid 5 可能未映射
+		must(syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"))
+	}
+	shm := filepath.Join(dev, "shm")
+	os.MkdirAll(shm, 01777)
+	if shmFrom != "" {
+		// 宿主机上准备好的 /dev/shm：独立 IPC 时为容器自己的 tmpfs，共享宿主机或其它容器的 IPC 时一并共享
+		must(syscall.Mount(shmFrom, shm, "", syscall.MS_BIND|syscall.MS_REC, ""))
+		return
+	}
+	must(syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC,
+		fmt.Sprintf("mode=1777,size=%d", shmSize)))
+}
+
+// bind mount 一个宿主机设备节点，目标先创建为空文件
+func bindDevice(src, dst string) {
+	if f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY, 0666); err == nil {
+		f.Close()
+	}
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+		fmt.Printf("child: bind %s 到 %s 失败: %v\n", src, dst, err)
 	}
 }
 
@@ -130,7 +222,7 @@ func AttachChild() {
 	}
 	id := os.Args[2]
 	cmdArgs := os.Args[3:]
-	b, err := os.ReadFile("/tmp/container_" + id + ".json")
+	b, err := os.ReadFile(containerPath(id) + ".json")
 	if err != nil {
 		fmt.Println("找不到容器:", id)
 		return
@@ -2,97 +2,53 @@ package cmd
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/creack/pty"
 	"golang.org/x/sys/unix"
 )
 
-// 进入容器 namespace 并执行命令
-func ExecInContainer(idPrefix string, cmdArgs []string) {
+// 进入容器 namespace 并执行命令，-i 保持标准输入，-t 分配伪终端。
+// nsenter 负责进入 namespace，随后由 exec-child 加入容器 cgroup，
+// 并施加与容器主进程相同的 seccomp、能力集和用户限制
+func ExecInContainer(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	interactive := fs.Bool("i", false, "保持标准输入打开")
+	fs.BoolVar(interactive, "interactive", false, "-i 的全称")
+	tty := fs.Bool("t", false, "分配伪终端")
+	fs.BoolVar(tty, "tty", false, "-t 的全称")
+	parseFlags(fs, expandShortFlags(fs, args))
+	if fs.NArg() < 2 {
+		panic("exec 需要容器id和命令")
+	}
+	idPrefix, cmdArgs := fs.Arg(0), fs.Args()[1:]
 	id, err := FindContainerID(idPrefix)
 	if err != nil {
 		fmt.Println(err)
-		return
+		return exitRuntimeError
 	}
-	b, err := os.ReadFile("/tmp/container_" + id + ".json")
+	b, err := os.ReadFile(containerPath(id) + ".json")
 	if err != nil {
 		fmt.Println("找不到容器:", idPrefix)
-		return
+		return exitRuntimeError
 	}
 	var info ContainerInfo
 	json.Unmarshal(b, &info)
-
-	// 默认用 nsenter 实现 exec attach
-	useNsenter := true
-	if os.Getenv("EXEC_USE_NSENTER") == "0" {
-		useNsenter = false
-	}
-
-	if useNsenter {
-		// 优先读取 /tmp/container_<id>.env 作为环境变量
-		envFile := "/tmp/container_" + id + ".env"
-		env := []string{}
-		if b, err := os.ReadFile(envFile); err == nil {
-			for _, line := range strings.Split(string(b), "\n") {
-				if line != "" {
-					env = append(env, line)
-				}
-			}
-		} else {
-			// fallback 到 /proc/<pid>/environ
-			environPath := fmt.Sprintf("/proc/%d/environ", info.Pid)
-			if b, err := os.ReadFile(environPath); err == nil {
-				for _, kv := range strings.Split(string(b), "\x00") {
-					if kv != "" {
-						env = append(env, kv)
-					}
-				}
-			}
-		}
-		// 构造 nsenter 命令
-		nsenterArgs := []string{
-			"--target", fmt.Sprintf("%d", info.Pid),
-			"--mount", "--uts", "--ipc", "--net", "--pid", "--preserve-credentials",
-			"--",
-			"chroot", info.Rootfs,
-		}
-		nsenterArgs = append(nsenterArgs, cmdArgs...)
-		cmd := exec.Command("nsenter", nsenterArgs...)
-		cmd.Env = env
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("exec: nsenter 失败: %v\n", err)
-		}
-		return
+	if !containerRunning(id) {
+		fmt.Println("容器未运行:", id)
+		return exitRuntimeError
 	}
 
-	// 旧方式：go setns+chroot
-	nsList := []string{"mnt", "uts", "ipc", "net", "pid"}
-	for _, ns := range nsList {
-		fd, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", info.Pid, ns))
-		if err != nil {
-			fmt.Printf("exec: 打开 namespace %s 失败: %v\n", ns, err)
-			continue
-		}
-		importUnixSetns(fd.Fd())
-		fd.Close()
-	}
-	if err := syscall.Chroot(info.Rootfs); err != nil {
-		fmt.Printf("exec: chroot 失败: %v\n", err)
-		return
-	}
-	if err := os.Chdir("/"); err != nil {
-		fmt.Printf("exec: chdir 失败: %v\n", err)
-		return
-	}
-	// 优先读取 /tmp/container_<id>.env 作为环境变量
-	envFile := "/tmp/container_" + id + ".env"
+	// 优先读取 <状态目录>/container_<id>.env 作为环境变量
+	envFile := containerPath(id) + ".env"
 	env := []string{}
 	if b, err := os.ReadFile(envFile); err == nil {
 		for _, line := range strings.Split(string(b), "\n") {
@@ -101,6 +57,7 @@ func ExecInContainer(idPrefix string, cmdArgs []string) {
 			}
 		}
 	} else {
+		// fallback 到 /proc/<pid>/environ
 		environPath := fmt.Sprintf("/proc/%d/environ", info.Pid)
 		if b, err := os.ReadFile(environPath); err == nil {
 			for _, kv := range strings.Split(string(b), "\x00") {
@@ -110,68 +67,269 @@ func ExecInContainer(idPrefix string, cmdArgs []string) {
 			}
 		}
 	}
-	must(syscall.Exec(cmdArgs[0], cmdArgs, env))
+	selfExe, err := os.Executable()
+	must(err)
+	// 构造 nsenter 命令。cgroup namespace 由 exec-child 加入 cgroup 之后再进入
+	nsenterArgs := []string{"--target", fmt.Sprintf("%d", info.Pid)}
+	for _, ns := range [][2]string{{"mnt", "--mount"}, {"uts", "--uts"}, {"ipc", "--ipc"}, {"net", "--net"}, {"pid", "--pid"}} {
+		// 与宿主机共享的 namespace（rootless 的 net、--ipc=host）不必进入，rootless 时也没有权限进入
+		if !sharedWithHost(info.Pid, ns[0]) {
+			nsenterArgs = append(nsenterArgs, ns[1])
+		}
+	}
+	if info.Rootless {
+		// 进入容器的 user namespace，以其中的 root 身份执行
+		nsenterArgs = append(nsenterArgs, "--user")
+	}
+	// 用户由 exec-child 切换，nsenter 不做 setgroups（rootless 只映射一个 id 时不允许）
+	nsenterArgs = append(nsenterArgs, "--preserve-credentials")
+	if len(info.TimeOffsets) > 0 {
+		// --init 时容器主进程是 unshare 之后没有 exec 过的 init，仍在宿主机的 time namespace 中，
+		// 按 time_for_children 进入容器命令所在的 time namespace
+		nsenterArgs = append(nsenterArgs, fmt.Sprintf("--time=/proc/%d/ns/time_for_children", info.Pid))
+	}
+	nsenterArgs = append(nsenterArgs, "--", selfExe, "exec-child")
+	nsenterArgs = append(nsenterArgs, cmdArgs...)
+	cmd := exec.Command("nsenter", nsenterArgs...)
+	cmd.Env = env
+	// fd 3 传递容器元数据，fd 4 为容器的 cgroup namespace
+	cfgR, cfgW, err := os.Pipe()
+	must(err)
+	defer cfgR.Close()
+	cgns, err := os.Open(fmt.Sprintf("/proc/%d/ns/cgroup", info.Pid))
+	must(err)
+	defer cgns.Close()
+	cmd.ExtraFiles = []*os.File{cfgR, cgns}
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if info.CgroupMode == cgroupModeV2 {
+		// 与容器主进程一样用 CLONE_INTO_CGROUP 直接在容器 cgroup 中创建
+		cg, err := newCgroupV2(info.ID).Open()
+		must(err)
+		defer cg.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cg.Fd())
+	}
+	go func() {
+		json.NewEncoder(cfgW).Encode(info)
+		cfgW.Close()
+	}()
+	if *tty {
+		err = execWithPty(cmd, *interactive)
+	} else {
+		// 没有 -i 时命令的标准输入为 /dev/null
+		if *interactive {
+			cmd.Stdin = os.Stdin
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	}
+	// 命令在容器中运行过则返回它的退出码（nsenter 会原样传递），否则是 nsenter 本身启动失败
+	if _, ok := err.(*exec.ExitError); err == nil || ok {
+		return exitCode(cmd.ProcessState)
+	}
+	fmt.Printf("exec: nsenter 失败: %v\n", err)
+	return exitRuntimeError
 }
 
-// 兼容 go1.22+ 的 namespace 切换
-func importUnixSetns(fd uintptr) {
-	// 推荐在文件顶部 import "golang.org/x/sys/unix"
-	// 实现为
-	unix.Setns(int(fd), 0)
-	// panic("请在文件顶部添加 import \"golang.org/x/sys/unix\"，并将此函数实现为 unix.Setns(int(fd), 0)")
+// 容器进程与当前进程位于同一个 namespace
+func sharedWithHost(pid int, ns string) bool {
+	self, err := os.Readlink("/proc/self/ns/" + ns)
+	if err != nil {
+		return false
+	}
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+	return err == nil && self == target
 }
 
-// 停止容器（杀死主进程）
-func StopContainer(idPrefix string) {
-	id, err := FindContainerID(idPrefix)
+// exec-child: 由 nsenter 在容器的 namespace 中启动，加入容器 cgroup 和 cgroup namespace，
+// chroot 到容器根目录，收缩到与容器主进程相同的权限后执行命令
+func ExecChild() {
+	// 能力集等设置只对调用线程生效，锁定线程保证它们和最后的 exec 在同一线程
+	runtime.LockOSThread()
+	if len(os.Args) < 3 {
+		panic("exec-child 需要命令")
+	}
+	cmdArgs := os.Args[2:]
+	cfg, cgns := os.NewFile(3, "exec-config"), os.NewFile(4, "cgroup-ns")
+	var info ContainerInfo
+	must(json.NewDecoder(cfg).Decode(&info))
+	cfg.Close()
+	// v2 在启动 nsenter 时已通过 CLONE_INTO_CGROUP 进入容器 cgroup
+	if info.CgroupMode == cgroupModeV1 {
+		must(newCgroupV1(info.ID).Join())
+	}
+	must(unix.Setns(int(cgns.Fd()), unix.CLONE_NEWCGROUP))
+	cgns.Close()
+	must(syscall.Chroot(info.Rootfs))
+	must(os.Chdir("/"))
+	if info.WorkingDir != "" {
+		must(os.Chdir(info.WorkingDir))
+	}
+	user, err := resolveUser(info.User)
+	must(err)
+	must(dropPrivileges(info, user))
+	path, err := lookupCommand(cmdArgs[0])
 	if err != nil {
-		fmt.Println(err)
-		return
+		panic(err)
 	}
-	b, err := os.ReadFile("/tmp/container_" + id + ".json")
+	panic(execError(cmdArgs[0], syscall.Exec(path, cmdArgs, os.Environ())))
+}
+
+// 在伪终端中运行 exec 命令，窗口大小随宿主机终端同步；interactive 时终端切到 raw 模式并转发标准输入
+func execWithPty(cmd *exec.Cmd, interactive bool) error {
+	ptmx, err := pty.StartWithSize(cmd, terminalSize())
 	if err != nil {
-		fmt.Println("找不到容器:", idPrefix)
-		return
+		return err
 	}
-	var info ContainerInfo
-	json.Unmarshal(b, &info)
-	if info.Pid > 0 {
-		err := syscall.Kill(info.Pid, syscall.SIGKILL)
-		if err != nil {
-			fmt.Printf("停止容器 %s 失败: %v\n", id, err)
-		} else {
-			fmt.Printf("已停止容器 %s (pid=%d)\n", id, info.Pid)
+	defer ptmx.Close()
+	defer watchResize(func(ws *pty.Winsize) { pty.Setsize(ptmx, ws) })()
+	if interactive {
+		if restore, err := makeRaw(os.Stdin); err == nil {
+			defer restore()
 		}
+		go io.Copy(ptmx, os.Stdin)
 	}
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, ptmx)
+		close(outputDone)
+	}()
+	err = cmd.Wait()
+	waitOutput(outputDone)
+	return err
 }
 
-// 删除容器（清理挂载和元数据）
-func RmContainer(idPrefix string) {
-	id, err := FindContainerID(idPrefix)
-	if err != nil {
-		fmt.Println(err)
-		return
+// stop: 先发送 StopSignal（默认 SIGTERM），超时仍未退出再发送 SIGKILL
+func StopContainer(args []string) {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	timeout := fs.Int("t", 10, "等待容器退出的秒数，超时后发送 SIGKILL")
+	fs.IntVar(timeout, "time", 10, "-t 的全称")
+	signal := fs.String("signal", "", "停止信号，默认使用镜像的 StopSignal 或 SIGTERM")
+	fs.StringVar(signal, "s", "", "--signal 的简写")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		panic("stop 需要容器id")
+	}
+	for _, idPrefix := range fs.Args() {
+		id, err := FindContainerID(idPrefix)
+		must(err)
+		info, err := loadContainerInfo(id)
+		must(err)
+		sigName := *signal
+		if sigName == "" {
+			sigName = info.StopSignal
+		}
+		sig := syscall.SIGTERM
+		if sigName != "" {
+			sig, err = parseSignal(sigName)
+			must(err)
+		}
+		if !containerRunning(id) {
+			fmt.Printf("容器 %s 未运行\n", id)
+			continue
+		}
+		if err := syscall.Kill(info.Pid, sig); err != nil && err != syscall.ESRCH {
+			panic(fmt.Sprintf("停止容器 %s 失败: %v", id, err))
+		}
+		if !waitProcessExit(info.Pid, time.Duration(*timeout)*time.Second) {
+			fmt.Printf("容器 %s 在 %d 秒内未退出，发送 SIGKILL\n", id, *timeout)
+			sig = syscall.SIGKILL
+			syscall.Kill(info.Pid, sig)
+			waitProcessExit(info.Pid, -1)
+		}
+		info = recordStopped(id, sig)
+		fmt.Printf("已停止容器 %s (pid=%d)，退出码 %d\n", id, info.Pid, info.ExitCode)
 	}
-	b, err := os.ReadFile("/tmp/container_" + id + ".json")
+}
+
+// 等待 shim（或前台 run 进程）写入退出码；它们已不在时由 stop 自己记录并清理
+func recordStopped(id string, sig syscall.Signal) ContainerInfo {
+	info, err := loadContainerInfo(id)
 	if err != nil {
-		fmt.Println("找不到容器:", idPrefix)
-		return
+		return info
 	}
-	var info ContainerInfo
-	json.Unmarshal(b, &info)
-	// 卸载 overlay2
-	if info.Rootfs != "" {
-		_ = syscallUnmount(info.Rootfs)
+	if info.ShimPid > 0 {
+		waitProcessExit(info.ShimPid, 5*time.Second)
 	}
-	// 删除 json 文件
-	os.Remove("/tmp/container_" + id + ".json")
-	// 删除 base 目录及所有子目录
-	if info.Rootfs != "" {
-		base := info.Rootfs
-		if len(base) > 7 && base[len(base)-7:] == "/merged" {
-			base = base[:len(base)-7]
+	deadline := time.Now().Add(2 * time.Second)
+	for info.Status != statusExited && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		latest, err := loadContainerInfo(id)
+		if err != nil {
+			// --rm 的容器已被删除
+			return info
+		}
+		info = latest
+	}
+	if info.Status != statusExited {
+		markExited(&info, 128+int(sig))
+		saveContainerInfo(info)
+		cleanupContainer(info, false)
+	}
+	return info
+}
+
+// kill: 向容器主进程发送信号，默认 SIGKILL
+func KillContainer(args []string) {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	signal := fs.String("s", "SIGKILL", "发送的信号")
+	fs.StringVar(signal, "signal", "SIGKILL", "-s 的全称")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		panic("kill 需要容器id")
+	}
+	sig, err := parseSignal(*signal)
+	must(err)
+	for _, idPrefix := range fs.Args() {
+		id, err := FindContainerID(idPrefix)
+		must(err)
+		if !containerRunning(id) {
+			panic("容器未运行: " + id)
+		}
+		info, err := loadContainerInfo(id)
+		must(err)
+		if err := syscall.Kill(info.Pid, sig); err != nil {
+			panic(fmt.Sprintf("向容器 %s 发送 %v 失败: %v", id, sig, err))
+		}
+		fmt.Println(id)
+	}
+}
+
+// 删除容器（清理挂载和元数据）。运行中的容器需要 -f，先用 SIGKILL 停止再删除
+func RmContainer(args []string) {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	force := fs.Bool("f", false, "强制删除运行中的容器")
+	fs.BoolVar(force, "force", false, "-f 的全称")
+	parseFlags(fs, args)
+	if fs.NArg() == 0 {
+		panic("rm 需要容器id")
+	}
+	for _, idPrefix := range fs.Args() {
+		id, err := FindContainerID(idPrefix)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		info, err := loadContainerInfo(id)
+		if err != nil {
+			fmt.Println("找不到容器:", idPrefix)
+			continue
+		}
+		if containerRunning(id) {
+			if !*force {
+				panic(fmt.Sprintf("容器 %s 正在运行，请先 stop 或使用 rm -f", id))
+			}
+			if err := syscall.Kill(info.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				panic(fmt.Sprintf("停止容器 %s 失败: %v", id, err))
+			}
+			waitProcessExit(info.Pid, -1)
+			info = recordStopped(id, syscall.SIGKILL)
 		}
-		os.RemoveAll(base)
+		// 卸载 overlay2 和 /dev/shm，删除 cgroup 和容器目录
+		cleanupContainer(info, true)
+		// 删除 json、env 和日志文件
+		removeContainerState(id)
+		fmt.Printf("已删除容器 %s\n", id)
 	}
-	fmt.Printf("已删除容器 %s\n", id)
 }
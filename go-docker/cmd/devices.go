@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// --device 指定的设备映射，格式 /dev/fuse 或 /dev/loop0:/dev/loop0:rwm
+type deviceMapping struct {
+	HostPath    string `json:"host_path"`
+	Path        string `json:"path"`
+	Permissions string `json:"permissions"`
+}
+
+// 设备 cgroup 规则，与 v1 devices.allow 的写法一致：类型 a/c/b，主次设备号 -1 表示任意，权限 rwm
+type deviceRule struct {
+	Type   byte   `json:"type"`
+	Major  int64  `json:"major"`
+	Minor  int64  `json:"minor"`
+	Access string `json:"access"`
+}
+
+func (r deviceRule) String() string {
+	num := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%c %s:%s %s", r.Type, num(r.Major), num(r.Minor), r.Access)
+}
+
+// 与 Docker 相同的默认设备白名单：允许 mknod 任意设备，但只能读写标准设备和 pty
+var defaultDeviceRules = []deviceRule{
+	{Type: 'c', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'b', Major: -1, Minor: -1, Access: "m"},
+	{Type: 'c', Major: 1, Minor: 3, Access: "rwm"},    // null
+	{Type: 'c', Major: 1, Minor: 5, Access: "rwm"},    // zero
+	{Type: 'c', Major: 1, Minor: 7, Access: "rwm"},    // full
+	{Type: 'c', Major: 1, Minor: 8, Access: "rwm"},    // random
+	{Type: 'c', Major: 1, Minor: 9, Access: "rwm"},    // urandom
+	{Type: 'c', Major: 5, Minor: 0, Access: "rwm"},    // tty
+	{Type: 'c', Major: 5, Minor: 1, Access: "rwm"},    // console
+	{Type: 'c', Major: 5, Minor: 2, Access: "rwm"},    // ptmx
+	{Type: 'c', Major: 136, Minor: -1, Access: "rwm"}, // pts
+	{Type: 'c', Major: 10, Minor: 200, Access: "rwm"}, // tun
+}
+
+// 解析 --device，容器内路径默认与宿主机相同，权限默认 rwm
+func parseDeviceMapping(spec string) (deviceMapping, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return deviceMapping{}, fmt.Errorf("--device 格式错误: %s", spec)
+	}
+	d := deviceMapping{HostPath: parts[0], Path: parts[0], Permissions: "rwm"}
+	if len(parts) == 2 && validDeviceAccess(parts[1]) && !strings.HasPrefix(parts[1], "/") {
+		// /dev/fuse:rw 省略了容器内路径
+		d.Permissions = parts[1]
+	} else if len(parts) >= 2 && parts[1] != "" {
+		d.Path = parts[1]
+	}
+	if len(parts) == 3 {
+		d.Permissions = parts[2]
+	}
+	if !filepath.IsAbs(d.HostPath) || !filepath.IsAbs(d.Path) {
+		return deviceMapping{}, fmt.Errorf("--device 需要绝对路径: %s", spec)
+	}
+	if !validDeviceAccess(d.Permissions) {
+		return deviceMapping{}, fmt.Errorf("--device 权限只能是 r、w、m 的组合: %s", spec)
+	}
+	return d, nil
+}
+
+func validDeviceAccess(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("rwm", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// 根据宿主机上的设备节点生成 cgroup 规则
+func (d deviceMapping) rule() (deviceRule, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(d.HostPath, &st); err != nil {
+		return deviceRule{}, fmt.Errorf("--device %s: %v", d.HostPath, err)
+	}
+	r := deviceRule{
+		Major:  int64(unix.Major(uint64(st.Rdev))),
+		Minor:  int64(unix.Minor(uint64(st.Rdev))),
+		Access: d.Permissions,
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		r.Type = 'c'
+	case unix.S_IFBLK:
+		r.Type = 'b'
+	default:
+		return deviceRule{}, fmt.Errorf("--device %s 不是设备文件", d.HostPath)
+	}
+	return r, nil
+}
+
+// 在容器的 /dev 中 bind 宿主机设备，需在 setupDev 之后、chroot 之前调用。
+// 容器路径在 rootfs 内解析，镜像中的符号链接不会把设备节点建到宿主机上
+func bindDevices(rootfs string, devices []deviceMapping) error {
+	for _, d := range devices {
+		target, err := resolveInRoot(rootfs, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("创建设备 %s 的目录失败: %v", d.Path, err)
+		}
+		bindDevice(d.HostPath, target)
+	}
+	return nil
+}
+
+// 能否通过 cgroup 设置设备白名单：v2 使用 BPF 程序，v1 需要挂载 devices 控制器
+func deviceCgroupAvailable(mode string) bool {
+	switch mode {
+	case cgroupModeV2:
+		return true
+	case cgroupModeV1:
+		return (&cgroupV1{}).mounted("devices")
+	}
+	return false
+}
+
+// 把设备规则写入 v1 的 devices 控制器：先全部禁止，再逐条放行
+func (c *cgroupV1) applyDevices(rules []deviceRule) error {
+	if err := c.write("devices", "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if err := c.write("devices", "devices.allow", r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// v2 没有 devices 控制器，设备访问由挂在 cgroup 上的 BPF_PROG_TYPE_CGROUP_DEVICE 程序决定
+func (c *cgroupV2) applyDevices(rules []deviceRule) error {
+	insns, err := compileDeviceFilter(rules)
+	if err != nil {
+		return err
+	}
+	progFd, err := loadDeviceFilter(insns)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(progFd)
+	dir, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// 挂载后程序由 cgroup 持有引用，fd 可以关闭
+	attr := struct {
+		TargetFd    uint32
+		AttachBpfFd uint32
+		AttachType  uint32
+		AttachFlags uint32
+	}{uint32(dir.Fd()), uint32(progFd), unix.BPF_CGROUP_DEVICE, unix.BPF_F_ALLOW_MULTI}
+	if _, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_ATTACH, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr)); errno != 0 {
+		return fmt.Errorf("挂载设备 BPF 程序失败: %v", errno)
+	}
+	return nil
+}
+
+// eBPF 指令，寄存器字段低 4 位为 dst，高 4 位为 src
+type ebpfInsn struct {
+	Code uint8
+	Regs uint8
+	Off  int16
+	Imm  int32
+}
+
+func ebpf(code uint8, dst, src uint8, off int16, imm int32) ebpfInsn {
+	return ebpfInsn{Code: code, Regs: dst | src<<4, Off: off, Imm: imm}
+}
+
+// bpf_cgroup_dev_ctx 中的访问类型
+const (
+	bpfDevcgDevBlock = 1
+	bpfDevcgDevChar  = 2
+	bpfDevcgAccMknod = 1
+	bpfDevcgAccRead  = 2
+	bpfDevcgAccWrite = 4
+)
+
+// 把白名单编译为设备过滤程序。ctx 为 bpf_cgroup_dev_ctx{access_type, major, minor}，
+// access_type 低 16 位是设备类型，高 16 位是访问方式。任一规则命中返回 1（允许），否则返回 0。
+func compileDeviceFilter(rules []deviceRule) ([]ebpfInsn, error) {
+	const (
+		ldxw  = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+		andK  = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+		rshK  = unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K
+		movX  = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X
+		movK  = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_K
+		jneK  = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+		jneX  = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+		exitI = unix.BPF_JMP | unix.BPF_EXIT
+	)
+	// r2 = 类型，r3 = 访问方式，r4 = 主设备号，r5 = 次设备号
+	prog := []ebpfInsn{
+		ebpf(ldxw, 2, 1, 0, 0),
+		ebpf(andK, 2, 0, 0, 0xffff),
+		ebpf(ldxw, 3, 1, 0, 0),
+		ebpf(rshK, 3, 0, 0, 16),
+		ebpf(ldxw, 4, 1, 4, 0),
+		ebpf(ldxw, 5, 1, 8, 0),
+	}
+	for _, r := range rules {
+		var block []ebpfInsn
+		switch r.Type {
+		case 'a':
+		case 'c':
+			block = append(block, ebpf(jneK, 2, 0, 0, bpfDevcgDevChar))
+		case 'b':
+			block = append(block, ebpf(jneK, 2, 0, 0, bpfDevcgDevBlock))
+		default:
+			return nil, fmt.Errorf("未知的设备类型: %c", r.Type)
+		}
+		var access int32
+		for _, c := range r.Access {
+			switch c {
+			case 'r':
+				access |= bpfDevcgAccRead
+			case 'w':
+				access |= bpfDevcgAccWrite
+			case 'm':
+				access |= bpfDevcgAccMknod
+			}
+		}
+		if access != bpfDevcgAccMknod|bpfDevcgAccRead|bpfDevcgAccWrite {
+			// 请求的访问方式必须是规则允许的子集：(r3 & access) == r3
+			block = append(block,
+				ebpf(movX, 1, 3, 0, 0),
+				ebpf(andK, 1, 0, 0, access),
+				ebpf(jneX, 1, 3, 0, 0))
+		}
+		if r.Major >= 0 {
+			block = append(block, ebpf(jneK, 4, 0, 0, int32(r.Major)))
+		}
+		if r.Minor >= 0 {
+			block = append(block, ebpf(jneK, 5, 0, 0, int32(r.Minor)))
+		}
+		block = append(block, ebpf(movK, 0, 0, 0, 1), ebpf(exitI, 0, 0, 0, 0))
+		// 条件不满足时跳过本规则剩余的指令
+		for i := range block {
+			if block[i].Code == jneK || block[i].Code == jneX {
+				block[i].Off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+	prog = append(prog, ebpf(movK, 0, 0, 0, 0), ebpf(exitI, 0, 0, 0, 0))
+	return prog, nil
+}
+
+// 通过 bpf(BPF_PROG_LOAD) 加载设备过滤程序，返回程序 fd。
+// 先不带日志加载，失败后再开启校验器日志重试一次，便于定位错误。
+func loadDeviceFilter(insns []ebpfInsn) (int, error) {
+	code := make([]byte, 0, len(insns)*8)
+	for _, in := range insns {
+		code = append(code, in.Code, in.Regs)
+		code = binary.NativeEndian.AppendUint16(code, uint16(in.Off))
+		code = binary.NativeEndian.AppendUint32(code, uint32(in.Imm))
+	}
+	license := []byte("Apache\x00")
+	load := func(logBuf []byte) (int, syscall.Errno) {
+		attr := struct {
+			ProgType    uint32
+			InsnCnt     uint32
+			Insns       uint64
+			License     uint64
+			LogLevel    uint32
+			LogSize     uint32
+			LogBuf      uint64
+			KernVersion uint32
+			ProgFlags   uint32
+		}{
+			ProgType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+			InsnCnt:  uint32(len(insns)),
+			Insns:    uint64(uintptr(unsafe.Pointer(&code[0]))),
+			License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		}
+		if logBuf != nil {
+			attr.LogLevel = 1
+			attr.LogSize = uint32(len(logBuf))
+			attr.LogBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+		}
+		fd, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_LOAD, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		runtime.KeepAlive(code)
+		runtime.KeepAlive(license)
+		runtime.KeepAlive(logBuf)
+		return int(fd), errno
+	}
+	fd, errno := load(nil)
+	if errno == 0 {
+		return fd, nil
+	}
+	logBuf := make([]byte, 256*1024)
+	if fd, retry := load(logBuf); retry == 0 {
+		return fd, nil
+	}
+	return -1, fmt.Errorf("加载设备 BPF 程序失败: %v: %s", errno, strings.TrimRight(string(logBuf), "\x00"))
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 每个容器单独生成的 /etc 文件，保存在容器 base 目录下，启动时 bind mount 到 rootfs
+var etcFiles = []string{"hosts", "hostname", "resolv.conf"}
+
+// 生成 /etc/hosts、/etc/hostname、/etc/resolv.conf
+func writeEtcFiles(base string, info ContainerInfo) error {
+	var hosts strings.Builder
+	hosts.WriteString("127.0.0.1\tlocalhost\n")
+	hosts.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	hosts.WriteString("fe00::0\tip6-localnet\n")
+	hosts.WriteString("ff00::0\tip6-mcastprefix\n")
+	hosts.WriteString("ff02::1\tip6-allnodes\n")
+	hosts.WriteString("ff02::2\tip6-allrouters\n")
+	for _, h := range info.ExtraHosts {
+		name, ip, _ := strings.Cut(h, ":")
+		fmt.Fprintf(&hosts, "%s\t%s\n", ip, name)
+	}
+	// 容器与宿主机共用网络，主机名指向回环地址
+	fmt.Fprintf(&hosts, "127.0.1.1\t%s\n", info.Hostname)
+	if err := os.WriteFile(filepath.Join(base, "hosts"), []byte(hosts.String()), 0644); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(base, "hostname"), []byte(info.Hostname+"\n"), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(base, "resolv.conf"), []byte(resolvConf(info.DNS)), 0644)
+}
+
+// 未指定 --dns 时沿用宿主机的 resolv.conf，否则替换其中的 nameserver，保留 search/options
+func resolvConf(dns []string) string {
+	host, _ := os.ReadFile("/etc/resolv.conf")
+	if len(dns) == 0 {
+		return string(host)
+	}
+	var b strings.Builder
+	for _, d := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", d)
+	}
+	sc := bufio.NewScanner(strings.NewReader(string(host)))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "search") || strings.HasPrefix(line, "options") {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+// 把生成的文件 bind mount 到 rootfs/etc 下，避免写入 overlay 的 upper 层。
+// 镜像中的 /etc 可能是符号链接，在 rootfs 内解析，不会跟随到宿主机上
+func mountEtcFiles(rootfs, base string) error {
+	etc, err := resolveInRoot(rootfs, "/etc")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return err
+	}
+	for _, name := range etcFiles {
+		src := filepath.Join(base, name)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		dst := filepath.Join(etc, name)
+		// 符号链接会被 mount 跟随到 rootfs 之外，先删掉
+		if fi, err := os.Lstat(dst); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			os.Remove(dst)
+		}
+		// bind mount 的目标必须存在，镜像里没有时创建空文件
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			if f, err := os.Create(dst); err == nil {
+				f.Close()
+			}
+		}
+		if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+			fmt.Printf("child: 挂载 %s 到 %s 失败: %v\n", src, dst, err)
+		}
+	}
+	return nil
+}
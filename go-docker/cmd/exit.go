@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// go-docker 自身出错时的退出码，与 Docker 相同，便于和容器命令的退出码区分
+const (
+	exitRuntimeError  = 125 // go-docker 运行出错
+	exitNotExecutable = 126 // 容器命令无法执行
+	exitNotFound      = 127 // 容器命令不存在
+)
+
+// 带退出码的错误，panic 后由 HandleExit 以该退出码退出
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// 在 main 中 defer 调用：把 panic 转成错误信息和退出码，默认 125
+func HandleExit() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	code := exitRuntimeError
+	if e, ok := r.(*exitError); ok {
+		code = e.code
+	}
+	fmt.Fprintf(os.Stderr, "go-docker: %v\n", r)
+	os.Exit(code)
+}
+
+// 解析子命令的参数。参数错误也是 go-docker 自身的错误，panic 后由 HandleExit 以 125 退出；
+// -h 打印用法后正常退出
+func parseFlags(fs *flag.FlagSet, args []string) {
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	must(err)
+}
+
+// 容器进程的退出码，被信号杀死时为 128+信号值
+func exitCode(state *os.ProcessState) int {
+	if state == nil {
+		return -1
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+// 在容器的 PATH 中查找命令，找不到为 127，不可执行为 126
+func lookupCommand(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err == nil {
+		return path, nil
+	}
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EISDIR) {
+		return "", &exitError{exitNotExecutable, fmt.Errorf("%s: 没有执行权限", name)}
+	}
+	return "", &exitError{exitNotFound, fmt.Errorf("%s: 命令不存在", name)}
+}
+
+// exec 失败时按错误类型给出退出码
+func execError(name string, err error) error {
+	switch err {
+	case syscall.ENOENT:
+		return &exitError{exitNotFound, fmt.Errorf("%s: %v", name, err)}
+	case syscall.EACCES, syscall.ENOEXEC, syscall.EISDIR, syscall.EPERM:
+		return &exitError{exitNotExecutable, fmt.Errorf("%s: %v", name, err)}
+	}
+	return err
+}
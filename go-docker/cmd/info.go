@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// 输出宿主机与运行时信息
+func Info() {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		fmt.Printf("内核版本: %s\n", unix.ByteSliceToString(uts.Release[:]))
+	}
+	fmt.Printf("状态目录: %s\n", stateRoot())
+	fmt.Printf("Rootless: %v\n", isRootless())
+	files, _ := filepath.Glob(containerPath("*") + ".json")
+	fmt.Printf("容器数量: %d\n", len(files))
+	fmt.Println("Cgroup 驱动: cgroupfs")
+	switch detectCgroupMode() {
+	case cgroupModeV2:
+		fmt.Println("Cgroup 版本: 2 (unified)")
+		b, _ := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+		fmt.Printf("可用控制器: %s\n", strings.Join(strings.Fields(string(b)), " "))
+	case cgroupModeV1:
+		fmt.Println("Cgroup 版本: 1 (legacy)")
+		var ctrls []string
+		for _, ctrl := range cgroupV1Controllers {
+			if newCgroupV1("").mounted(ctrl) {
+				ctrls = append(ctrls, ctrl)
+			}
+		}
+		fmt.Printf("可用控制器: %s\n", strings.Join(ctrls, " "))
+	default:
+		fmt.Println("Cgroup 版本: 不可用（资源限制参数无法使用）")
+	}
+}
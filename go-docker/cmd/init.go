@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// --init：child 自己留作容器的 PID 1，以独立进程组启动容器命令，
+// 把收到的信号转发给该进程组，回收所有僵尸进程，并以容器命令的退出码退出。
+// execSync 为 shim 的同步管道，init 不会 exec，启动容器命令后手动关闭
+func runInit(path string, args, env []string, tty bool, execSync int) {
+	sigs := make(chan os.Signal, 32)
+	// 先开始接收信号，避免容器命令启动期间的信号被 PID 1 默认忽略
+	signal.Notify(sigs)
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	if tty {
+		// 让容器命令的进程组成为终端的前台进程组，Ctrl-C 等按键直接发给它
+		attr.Foreground = true
+		attr.Ctty = 0
+	}
+	proc, err := os.StartProcess(path, args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+		Sys:   attr,
+	})
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		panic(execError(args[0], err))
+	}
+	pid := proc.Pid
+	if execSync >= 0 {
+		syscall.Close(execSync)
+	}
+
+	go func() {
+		for s := range sigs {
+			sig := s.(syscall.Signal)
+			// SIGCHLD 由下面的 wait 处理，SIGURG 是 Go 运行时抢占调度用的
+			if sig == syscall.SIGCHLD || sig == syscall.SIGURG {
+				continue
+			}
+			// 容器命令自己换了进程组或会话时，退回只发给它本身
+			if syscall.Kill(-pid, sig) != nil {
+				syscall.Kill(pid, sig)
+			}
+		}
+	}()
+
+	// 回收所有子进程（包括被收养的孤儿进程），容器命令退出后随之退出
+	for {
+		var ws syscall.WaitStatus
+		wpid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			os.Exit(exitRuntimeError)
+		}
+		if wpid != pid {
+			continue
+		}
+		if ws.Signaled() {
+			os.Exit(128 + int(ws.Signal()))
+		}
+		os.Exit(ws.ExitStatus())
+	}
+}
@@ -0,0 +1,329 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// json-file 日志的一行，与 Docker 的格式相同
+type logEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// --log-opt 配置，MaxSize 为 0 表示不轮转
+type logConfig struct {
+	MaxSize int64 `json:"max_size,omitempty"`
+	MaxFile int   `json:"max_file,omitempty"`
+}
+
+// 解析 --log-opt max-size=10m / max-file=3
+func parseLogOpt(cfg *logConfig, spec string) error {
+	key, value, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("--log-opt 格式错误，应为 key=value: %s", spec)
+	}
+	switch key {
+	case "max-size":
+		n, err := parseBytes(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("--log-opt max-size 无效: %s", value)
+		}
+		cfg.MaxSize = n
+	case "max-file":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("--log-opt max-file 必须是正整数: %s", value)
+		}
+		cfg.MaxFile = n
+	default:
+		return fmt.Errorf("不支持的 --log-opt: %s", key)
+	}
+	return nil
+}
+
+// 容器日志文件路径，轮转后的旧文件依次为 .log.1、.log.2 ...
+func containerLogPath(id string) string {
+	return containerPath(id) + ".log"
+}
+
+// 按行写入 json-file 日志，超过 max-size 时轮转
+type jsonLogger struct {
+	mu   sync.Mutex
+	path string
+	cfg  logConfig
+	f    *os.File
+	size int64
+}
+
+func newJSONLogger(path string, cfg logConfig) (*jsonLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &jsonLogger{path: path, cfg: cfg, f: f, size: st.Size()}, nil
+}
+
+func (l *jsonLogger) log(stream, line string) {
+	b, _ := json.Marshal(logEntry{Log: line, Stream: stream, Time: time.Now().UTC()})
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.cfg.MaxSize {
+		if err := l.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "日志轮转失败: %v\n", err)
+		}
+	}
+	n, _ := l.f.Write(b)
+	l.size += int64(n)
+}
+
+// .log.N-1 -> .log.N ... .log -> .log.1，最多保留 max-file 个文件（含当前文件）
+func (l *jsonLogger) rotate() error {
+	l.f.Close()
+	maxFile := l.cfg.MaxFile
+	if maxFile < 1 {
+		maxFile = 1
+	}
+	if maxFile == 1 {
+		os.Remove(l.path)
+	}
+	for i := maxFile - 1; i >= 1; i-- {
+		from := l.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.path, i-1)
+		}
+		os.Rename(from, fmt.Sprintf("%s.%d", l.path, i))
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.size = 0
+	return nil
+}
+
+func (l *jsonLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// 返回按行切分后写入日志的 Writer，stream 为 stdout 或 stderr
+func (l *jsonLogger) writer(stream string) *logWriter {
+	return &logWriter{logger: l, stream: stream}
+}
+
+type logWriter struct {
+	logger *jsonLogger
+	stream string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.log(w.stream, string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+	}
+	// 没有换行的超长输出（如进度条）也按块落盘，避免无限缓存
+	if len(w.buf) >= 16*1024 {
+		w.Flush()
+	}
+	return len(p), nil
+}
+
+// 写出缓存中不完整的最后一行
+func (w *logWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.logger.log(w.stream, string(w.buf))
+		w.buf = nil
+	}
+}
+
+// logs: 读取容器日志，支持 -f、--since、--tail、-t
+func Logs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("f", false, "持续输出新日志，直到容器退出")
+	fs.BoolVar(follow, "follow", false, "-f 的全称")
+	since := fs.String("since", "", "只显示该时间之后的日志，RFC3339 时间或相对时长（如 10m）")
+	tail := fs.String("tail", "all", "只显示最后 N 行")
+	timestamps := fs.Bool("t", false, "显示时间戳")
+	fs.BoolVar(timestamps, "timestamps", false, "-t 的全称")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		panic("logs 需要容器id，例如 logs -f <id>")
+	}
+	id, err := FindContainerID(fs.Arg(0))
+	must(err)
+	var sinceTime time.Time
+	if *since != "" {
+		sinceTime, err = parseSince(*since)
+		must(err)
+	}
+	tailN := -1
+	if *tail != "all" {
+		tailN, err = strconv.Atoi(*tail)
+		if err != nil || tailN < 0 {
+			panic("--tail 必须是非负整数或 all")
+		}
+	}
+	emit := func(e logEntry) {
+		if !sinceTime.IsZero() && e.Time.Before(sinceTime) {
+			return
+		}
+		out := os.Stdout
+		if e.Stream == "stderr" {
+			out = os.Stderr
+		}
+		if *timestamps {
+			fmt.Fprintf(out, "%s %s", e.Time.Format(time.RFC3339Nano), e.Log)
+		} else {
+			fmt.Fprint(out, e.Log)
+		}
+	}
+
+	path := containerLogPath(id)
+	var entries []logEntry
+	for _, p := range logFiles(path) {
+		if p != path {
+			entries = append(entries, readLogEntries(p)...)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
+	var t *logTail
+	if f != nil {
+		defer func() { f.Close() }()
+		t = &logTail{r: bufio.NewReader(f)}
+		entries = append(entries, t.read()...)
+	}
+	if !sinceTime.IsZero() {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !e.Time.Before(sinceTime) {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+	if tailN >= 0 && len(entries) > tailN {
+		entries = entries[len(entries)-tailN:]
+	}
+	for _, e := range entries {
+		emit(e)
+	}
+	if !*follow || f == nil {
+		return
+	}
+	// 跟踪当前文件，轮转后重新打开
+	for {
+		for _, e := range t.read() {
+			emit(e)
+		}
+		if st, err := os.Stat(path); err == nil {
+			if cur, err := f.Stat(); err == nil && !os.SameFile(st, cur) {
+				f.Close()
+				if f, err = os.Open(path); err != nil {
+					return
+				}
+				t = &logTail{r: bufio.NewReader(f)}
+				continue
+			}
+		}
+		if !containerRunning(id) {
+			// 容器已退出，输出剩余日志后结束
+			for _, e := range t.read() {
+				emit(e)
+			}
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// 按时间从旧到新返回日志文件：.log.N ... .log.1、.log
+func logFiles(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(p); err != nil {
+			break
+		}
+		files = append([]string{p}, files...)
+	}
+	return append(files, path)
+}
+
+func readLogEntries(path string) []logEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	t := &logTail{r: bufio.NewReader(f)}
+	return t.read()
+}
+
+// 逐行读取日志文件，末尾尚未写完的半行暂存，文件继续增长后再拼上
+type logTail struct {
+	r       *bufio.Reader
+	partial []byte
+}
+
+func (t *logTail) read() []logEntry {
+	var entries []logEntry
+	for {
+		line, err := t.r.ReadBytes('\n')
+		t.partial = append(t.partial, line...)
+		if err != nil {
+			return entries
+		}
+		var e logEntry
+		if json.Unmarshal(t.partial, &e) == nil {
+			entries = append(entries, e)
+		}
+		t.partial = nil
+	}
+}
+
+// --since 支持 RFC3339 时间、Unix 时间戳和相对时长
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("--since 无效: %s", s)
+}
+
+// 容器主进程是否仍在运行
+func containerRunning(id string) bool {
+	info, err := loadContainerInfo(id)
+	return err == nil && containerStatus(info) == statusRunning
+}
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// --ipc 的取值
+const (
+	ipcModePrivate   = "private"
+	ipcModeHost      = "host"
+	ipcContainerPref = "container:"
+)
+
+// 解析 --ipc=host|private|container:<id>，container 模式把 id 前缀解析为完整 id
+func parseIPCMode(mode string, rootless bool) (string, error) {
+	switch mode {
+	case "", ipcModePrivate:
+		return ipcModePrivate, nil
+	case ipcModeHost:
+		return ipcModeHost, nil
+	}
+	prefix, ok := strings.CutPrefix(mode, ipcContainerPref)
+	if !ok || prefix == "" {
+		return "", fmt.Errorf("--ipc 只能是 host、private 或 container:<id>: %s", mode)
+	}
+	if rootless {
+		// 目标容器的 IPC namespace 属于它自己的 user namespace，新容器没有权限加入
+		return "", fmt.Errorf("rootless 模式不支持 --ipc=%s", mode)
+	}
+	id, err := FindContainerID(prefix)
+	if err != nil {
+		return "", err
+	}
+	pid, err := ipcContainerPid(id)
+	if err != nil {
+		return "", err
+	}
+	if syscall.Kill(pid, 0) != nil {
+		return "", fmt.Errorf("容器 %s 未运行，无法共享其 IPC namespace", id)
+	}
+	return ipcContainerPref + id, nil
+}
+
+// 共享 IPC 的目标容器进程 pid（宿主机 pid namespace 中）。
+// child 位于新的 pid namespace，不能用 kill 检查宿主机 pid，只能在挂载容器 /proc 之前通过宿主机的 /proc 访问
+func ipcContainerPid(id string) (int, error) {
+	target, err := loadContainerInfo(id)
+	if err != nil {
+		return 0, err
+	}
+	if target.Pid <= 0 {
+		return 0, fmt.Errorf("容器 %s 未运行，无法共享其 IPC namespace", id)
+	}
+	return target.Pid, nil
+}
+
+// 加入 --ipc=container:<id> 指定容器的 IPC namespace，需在挂载容器 /proc 之前调用
+func joinIPCNamespace(mode string) error {
+	id, ok := strings.CutPrefix(mode, ipcContainerPref)
+	if !ok {
+		return nil
+	}
+	pid, err := ipcContainerPid(id)
+	if err != nil {
+		return err
+	}
+	fd, err := os.Open(fmt.Sprintf("/proc/%d/ns/ipc", pid))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if err := unix.Setns(int(fd.Fd()), unix.CLONE_NEWIPC); err != nil {
+		return fmt.Errorf("加入容器 %s 的 IPC namespace 失败: %v", id, err)
+	}
+	return nil
+}
+
+// POSIX 共享内存位于 /dev/shm，返回要 bind 到容器 /dev/shm 的宿主机路径：
+// --ipc=host 时为宿主机的 /dev/shm，container 模式时为目标容器的 /dev/shm（目标自己也是共享来的则继续追溯），
+// 独立 IPC 时为 run 在容器目录下挂载的 tmpfs。rootless 模式返回空串，由 child 在容器内挂载 tmpfs。
+// 目标容器的 /dev/shm 挂载在它自己的 mount namespace 中，不能跨 namespace bind，因此 tmpfs 挂载在宿主机上
+func shmSource(info ContainerInfo) (string, error) {
+	if info.IPC == ipcModeHost {
+		return "/dev/shm", nil
+	}
+	if id, ok := strings.CutPrefix(info.IPC, ipcContainerPref); ok {
+		target, err := loadContainerInfo(id)
+		if err != nil {
+			return "", err
+		}
+		return shmSource(target)
+	}
+	if info.Rootless {
+		return "", nil
+	}
+	return containerShmPath(strings.TrimSuffix(info.Rootfs, "/merged")), nil
+}
+
+// 容器目录下 /dev/shm 的挂载点
+func containerShmPath(base string) string {
+	return filepath.Join(base, "shm")
+}
+
+// 在宿主机上为独立 IPC 的容器挂载 /dev/shm 使用的 tmpfs，需在启动 child 之前调用
+func mountShm(base string, size int64) error {
+	if size == 0 {
+		size = defaultShmSize
+	}
+	shm := containerShmPath(base)
+	if err := os.MkdirAll(shm, 01777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("shm", shm, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC,
+		fmt.Sprintf("mode=1777,size=%d", size)); err != nil {
+		return fmt.Errorf("挂载 /dev/shm 失败: %v", err)
+	}
+	return nil
+}
+
+// 卸载 mountShm 挂载的 tmpfs，共享它的容器仍在运行时懒卸载
+func unmountShm(base string) {
+	shm := containerShmPath(base)
+	if err := syscall.Unmount(shm, 0); err != nil {
+		syscall.Unmount(shm, syscall.MNT_DETACH)
+	}
+}
+
+// 解析 --time-offset monotonic=24h,boottime=-1h，值为 Go 时长或秒数
+func parseTimeOffsets(spec string) (map[string]time.Duration, error) {
+	offsets := map[string]time.Duration{}
+	for _, kv := range strings.Split(spec, ",") {
+		clock, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("--time-offset 格式错误，应为 monotonic=<时长>,boottime=<时长>: %s", spec)
+		}
+		if clock != "monotonic" && clock != "boottime" {
+			return nil, fmt.Errorf("--time-offset 只支持 monotonic 和 boottime: %s", clock)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			secs, err2 := strconv.ParseInt(value, 10, 64)
+			if err2 != nil {
+				return nil, fmt.Errorf("--time-offset 无效的时长 %q: %v", value, err)
+			}
+			d = time.Duration(secs) * time.Second
+		}
+		offsets[clock] = d
+	}
+	return offsets, nil
+}
+
+// 创建 time namespace 并写入时钟偏移。unshare 后当前线程不会立即进入新 namespace，
+// 偏移必须在有进程进入之前写入，exec 时才切换过去，所以在 exec 之前的同一线程上调用。
+// 需在挂载容器自己的 /proc 之后调用。
+func setupTimeNamespace(offsets map[string]time.Duration) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("创建 time namespace 失败: %v", err)
+	}
+	var lines []string
+	for clock, d := range offsets {
+		secs := int64(d / time.Second)
+		nsecs := int64(d % time.Second)
+		if nsecs < 0 {
+			// 内核要求纳秒部分在 [0, 1e9) 内
+			secs--
+			nsecs += int64(time.Second)
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %d", clock, secs, nsecs))
+	}
+	// timens_offsets 只在进程目录下，/proc/self 对应主线程，而 unshare 只影响当前线程，按线程 id 访问
+	if err := os.WriteFile(fmt.Sprintf("/proc/%d/timens_offsets", unix.Gettid()), []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return fmt.Errorf("写入 time namespace 偏移失败: %v", err)
+	}
+	return nil
+}
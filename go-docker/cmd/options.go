@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// run 命令的可选参数
+type runOptions struct {
+	Interactive bool // -i 保持标准输入打开
+	TTY         bool // -t 分配伪终端
+	Detach      bool // -d 后台运行
+	AutoRemove  bool // --rm 退出后删除容器
+	Name        string
+	Env         []string
+	Volumes     []volumeMount
+	WorkingDir  string
+	Init        bool // --init 使用内置的 init 作为 PID 1
+
+	Hostname   string
+	ExtraHosts []string
+	DNS        []string
+	Resources  resources
+	CapAdd     []string
+	CapDrop    []string
+	Privileged bool
+	// --security-opt，例如 seccomp=profile.json
+	SecurityOpt []string
+	// 由 --cap-add/--cap-drop/--privileged 和 --security-opt 得出的安全配置
+	Capabilities    []string
+	Seccomp         *seccompProfile
+	NoNewPrivileges bool
+	ReadOnly        bool
+	Tmpfs           []string
+	ShmSize         int64
+	Devices         []deviceMapping
+	User            string
+	Ulimits         []ulimit
+	OOMScoreAdj     int
+	Sysctls         map[string]string
+	IPC             string
+	TimeOffsets     map[string]time.Duration
+	Log             logConfig
+}
+
+// 可重复指定的字符串参数，例如 --dns 8.8.8.8 --dns 1.1.1.1
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// 内存大小参数，支持 512m、1g 等写法，-1 表示不限制
+type bytesValue int64
+
+func (b *bytesValue) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *bytesValue) Set(v string) error {
+	if v == "-1" {
+		*b = -1
+		return nil
+	}
+	n, err := parseBytes(v)
+	if err != nil {
+		return err
+	}
+	*b = bytesValue(n)
+	return nil
+}
+
+// 解析 run 的选项，遇到第一个非选项参数（镜像tag）即停止，返回剩余参数
+func parseRunOptions(args []string) (runOptions, []string) {
+	var opts runOptions
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.BoolVar(&opts.Interactive, "i", false, "保持标准输入打开")
+	fs.BoolVar(&opts.Interactive, "interactive", false, "-i 的全称")
+	fs.BoolVar(&opts.TTY, "t", false, "分配伪终端")
+	fs.BoolVar(&opts.TTY, "tty", false, "-t 的全称")
+	fs.BoolVar(&opts.Detach, "d", false, "后台运行，输出容器ID")
+	fs.BoolVar(&opts.Detach, "detach", false, "-d 的全称")
+	fs.BoolVar(&opts.Detach, "daemon", false, "同 -d，兼容旧写法")
+	fs.BoolVar(&opts.AutoRemove, "rm", false, "容器退出后自动删除")
+	fs.StringVar(&opts.Name, "name", "", "容器名，可代替容器ID使用")
+	var env []string
+	fs.Var((*stringList)(&env), "e", "环境变量，格式 KEY=VALUE 或 KEY（取宿主机的值），可重复")
+	fs.Var((*stringList)(&env), "env", "-e 的全称")
+	var volumes []string
+	fs.Var((*stringList)(&volumes), "v", "挂载宿主机目录，格式 /host:/container[:ro]，可重复")
+	fs.Var((*stringList)(&volumes), "volume", "-v 的全称")
+	fs.StringVar(&opts.WorkingDir, "w", "", "容器内的工作目录")
+	fs.StringVar(&opts.WorkingDir, "workdir", "", "-w 的全称")
+	fs.BoolVar(&opts.Init, "init", false, "以内置 init 作为 PID 1，转发信号并回收僵尸进程")
+	fs.StringVar(&opts.Hostname, "hostname", "", "容器主机名，默认为短容器ID")
+	fs.Var((*stringList)(&opts.ExtraHosts), "add-host", "追加 hosts 记录，格式 name:ip，可重复")
+	fs.Var((*stringList)(&opts.DNS), "dns", "DNS 服务器地址，可重复")
+	r := &opts.Resources
+	fs.Var((*bytesValue)(&r.Memory), "memory", "内存上限，例如 512m")
+	fs.Var((*bytesValue)(&r.Memory), "m", "--memory 的简写")
+	fs.Var((*bytesValue)(&r.MemorySwap), "memory-swap", "内存+swap 总上限，-1 表示 swap 不限制")
+	fs.Float64Var(&r.CPUs, "cpus", 0, "可使用的 CPU 数量，例如 1.5")
+	fs.Int64Var(&r.CPUShares, "cpu-shares", 0, "CPU 相对权重")
+	fs.Int64Var(&r.PidsLimit, "pids-limit", 0, "进程数上限，-1 表示不限制")
+	fs.StringVar(&r.CpusetCpus, "cpuset-cpus", "", "允许使用的 CPU，例如 0-3,5")
+	fs.StringVar(&r.CpusetMems, "cpuset-mems", "", "允许使用的 NUMA 节点")
+	fs.Var((*stringList)(&r.DeviceReadBps), "device-read-bps", "设备读速率上限，格式 /dev/sda:1mb，可重复")
+	fs.Var((*stringList)(&r.DeviceWriteBps), "device-write-bps", "设备写速率上限，格式 /dev/sda:1mb，可重复")
+	fs.Var((*stringList)(&opts.CapAdd), "cap-add", "增加能力，例如 NET_ADMIN，可重复")
+	fs.Var((*stringList)(&opts.CapDrop), "cap-drop", "去掉能力，ALL 表示全部，可重复")
+	fs.BoolVar(&opts.Privileged, "privileged", false, "特权模式：保留全部能力，/sys 与 cgroup 可写")
+	fs.Var((*stringList)(&opts.SecurityOpt), "security-opt", "安全选项：seccomp=<profile.json>|unconfined、no-new-privileges，可重复")
+	fs.BoolVar(&opts.ReadOnly, "read-only", false, "以只读方式挂载容器根目录")
+	fs.Var((*stringList)(&opts.Tmpfs), "tmpfs", "挂载 tmpfs，格式 /run[:size=64m]，可重复")
+	fs.Var((*bytesValue)(&opts.ShmSize), "shm-size", "/dev/shm 大小，默认 64m")
+	fs.StringVar(&opts.User, "user", "", "容器进程的用户，格式 name|uid[:group|gid]")
+	fs.StringVar(&opts.User, "u", "", "--user 的简写")
+	fs.IntVar(&opts.OOMScoreAdj, "oom-score-adj", 0, "容器进程的 oom_score_adj，范围 -1000 到 1000")
+	var ulimits []string
+	fs.Var((*stringList)(&ulimits), "ulimit", "资源限制，格式 nofile=65536:65536，可重复")
+	fs.StringVar(&opts.IPC, "ipc", ipcModePrivate, "IPC namespace：host、private 或 container:<id>")
+	var timeOffset string
+	fs.StringVar(&timeOffset, "time-offset", "", "在独立的 time namespace 中偏移时钟，格式 monotonic=24h,boottime=24h")
+	var logOpts []string
+	fs.Var((*stringList)(&logOpts), "log-opt", "日志选项，max-size=10m 或 max-file=3，可重复")
+	var sysctls []string
+	fs.Var((*stringList)(&sysctls), "sysctl", "容器 namespace 内的内核参数，格式 kernel.shm_rmid_forced=1，可重复")
+	var devices []string
+	fs.Var((*stringList)(&devices), "device", "映射宿主机设备，格式 /dev/fuse 或 /dev/loop0:/dev/loop0:rwm，可重复")
+	parseFlags(fs, expandShortFlags(fs, args))
+	if opts.Hostname != "" && !validHostname(opts.Hostname) {
+		panic("--hostname 无效，需符合 RFC 1123 且不超过 64 字节: " + opts.Hostname)
+	}
+	if opts.Name != "" && !validContainerName(opts.Name) {
+		panic("容器名无效，只能包含字母、数字和 _.-，且以字母或数字开头: " + opts.Name)
+	}
+	for _, kv := range env {
+		key, _, hasValue := strings.Cut(kv, "=")
+		if key == "" {
+			panic("-e 格式错误: " + kv)
+		}
+		if !hasValue {
+			// 只给出变量名时取宿主机的值，宿主机未设置则忽略
+			v, ok := os.LookupEnv(key)
+			if !ok {
+				continue
+			}
+			kv = key + "=" + v
+		}
+		opts.Env = append(opts.Env, kv)
+	}
+	for _, spec := range volumes {
+		v, err := parseVolume(spec)
+		must(err)
+		opts.Volumes = append(opts.Volumes, v)
+	}
+	for _, spec := range opts.Tmpfs {
+		_, _, _, err := parseTmpfs(spec)
+		must(err)
+	}
+	if opts.WorkingDir != "" && !filepath.IsAbs(opts.WorkingDir) {
+		panic("-w 需要绝对路径: " + opts.WorkingDir)
+	}
+	// --memory-swap 是内存与 swap 的总量，只有同时指定 --memory 才能算出 swap 部分
+	if r.MemorySwap > 0 && r.Memory <= 0 {
+		panic("--memory-swap 需要同时指定 --memory")
+	}
+	if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+		panic(fmt.Sprintf("--memory-swap(%d) 不能小于 --memory(%d)", r.MemorySwap, r.Memory))
+	}
+	if opts.OOMScoreAdj < -1000 || opts.OOMScoreAdj > 1000 {
+		panic(fmt.Sprintf("--oom-score-adj 超出范围 [-1000, 1000]: %d", opts.OOMScoreAdj))
+	}
+	for _, spec := range ulimits {
+		u, err := parseUlimit(spec)
+		must(err)
+		opts.Ulimits = append(opts.Ulimits, u)
+	}
+	ipc, err := parseIPCMode(opts.IPC, isRootless())
+	must(err)
+	opts.IPC = ipc
+	opts.Capabilities, err = resolveCaps(opts.CapAdd, opts.CapDrop, opts.Privileged)
+	must(err)
+	must(parseSecurityOpts(&opts))
+	if timeOffset != "" {
+		opts.TimeOffsets, err = parseTimeOffsets(timeOffset)
+		must(err)
+	}
+	for _, spec := range logOpts {
+		must(parseLogOpt(&opts.Log, spec))
+	}
+	for _, spec := range sysctls {
+		key, value, err := parseSysctl(spec)
+		must(err)
+		must(checkSysctlNamespace(key, opts.IPC))
+		if opts.Sysctls == nil {
+			opts.Sysctls = map[string]string{}
+		}
+		opts.Sysctls[key] = value
+	}
+	for _, spec := range devices {
+		d, err := parseDeviceMapping(spec)
+		must(err)
+		opts.Devices = append(opts.Devices, d)
+	}
+
+	for _, h := range opts.ExtraHosts {
+		name, ip, ok := strings.Cut(h, ":")
+		if !ok || name == "" || net.ParseIP(ip) == nil {
+			panic(fmt.Sprintf("--add-host 格式错误: %s，应为 name:ip", h))
+		}
+	}
+	for _, d := range opts.DNS {
+		if net.ParseIP(d) == nil {
+			panic("--dns 不是合法的IP地址: " + d)
+		}
+	}
+	return opts, fs.Args()
+}
+
+// 展开 -it、-dit 这类合并写法的布尔短选项。遇到第一个非选项参数（镜像tag）即停止，
+// 需要取值的选项跳过其后的参数，避免把选项值当作镜像
+func expandShortFlags(fs *flag.FlagSet, args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" || a == "-" || !strings.HasPrefix(a, "-") {
+			return append(out, args[i:]...)
+		}
+		name := strings.TrimLeft(a, "-")
+		if strings.Contains(name, "=") {
+			out = append(out, a)
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil && !strings.HasPrefix(a, "--") && boolShortFlags(fs, name) {
+			for _, c := range name {
+				out = append(out, "-"+string(c))
+			}
+			continue
+		}
+		out = append(out, a)
+		if f != nil && !isBoolFlag(f) && i+1 < len(args) {
+			i++
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// name 中每个字符都是布尔短选项
+func boolShortFlags(fs *flag.FlagSet, name string) bool {
+	if len(name) < 2 {
+		return false
+	}
+	for _, c := range name {
+		f := fs.Lookup(string(c))
+		if f == nil || !isBoolFlag(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// 容器名规则与 Docker 相同：[a-zA-Z0-9][a-zA-Z0-9_.-]*
+func validContainerName(name string) bool {
+	for i, c := range name {
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if !alnum && (i == 0 || !strings.ContainsRune("_.-", c)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// 主机名规则：RFC 1123，各段为字母、数字和 -，不以 - 开头或结尾，每段不超过 63 字节，
+// 总长不超过内核的 HOST_NAME_MAX（64）
+func validHostname(name string) bool {
+	if len(name) > 64 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 解析 --security-opt，特权容器默认不启用 seccomp
+func parseSecurityOpts(opts *runOptions) error {
+	if !opts.Privileged {
+		opts.Seccomp = defaultSeccompProfile()
+	}
+	for _, o := range opts.SecurityOpt {
+		// 与 Docker 相同，键值之间可以用 = 或 :，例如 no-new-privileges:true、seccomp:unconfined
+		key, val := o, ""
+		if i := strings.IndexAny(o, "=:"); i >= 0 {
+			key, val = o[:i], o[i+1:]
+		}
+		switch key {
+		case "no-new-privileges":
+			if val == "" {
+				val = "true"
+			}
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("--security-opt %s 的值无效: %s", key, val)
+			}
+			opts.NoNewPrivileges = v
+		case "seccomp":
+			if val == "unconfined" {
+				opts.Seccomp = nil
+				continue
+			}
+			p, err := loadSeccompProfile(val)
+			if err != nil {
+				return err
+			}
+			opts.Seccomp = p
+		default:
+			return fmt.Errorf("不支持的 --security-opt: %s", o)
+		}
+	}
+	return nil
+}
@@ -11,7 +11,7 @@ import (
 
 // 列出所有容器id
 func Ps() {
-	files, err := filepath.Glob("/tmp/container_*.json")
+	files, err := filepath.Glob(containerPath("*") + ".json")
 	if err != nil {
 		fmt.Println("读取容器元数据失败:", err)
 		return
@@ -21,31 +21,33 @@ func Ps() {
 		showAll = true
 	}
 	// 打印表头
-	fmt.Printf("%-22s %-8s %-8s %-8s\n", "CONTAINER ID", "PID", "STATUS", "ROOTFS")
+	fmt.Printf("%-22s %-16s %-8s %-24s %-8s\n", "CONTAINER ID", "NAME", "PID", "STATUS", "ROOTFS")
 	for _, f := range files {
 		b, _ := os.ReadFile(f)
 		var info ContainerInfo
 		json.Unmarshal(b, &info)
-		// 检查主进程 pid 是否存在于宿主机
-		pidExists := false
-		if info.Pid > 0 {
-			_, err := os.Stat(fmt.Sprintf("/proc/%d", info.Pid))
-			if err == nil {
-				pidExists = true
-			}
-		}
-		status := "Exited"
-		if pidExists {
-			status = "Running"
+		status := containerStatus(info)
+		if status != statusRunning && !showAll {
+			continue
 		}
-		if pidExists || showAll {
-			fmt.Printf("%-22s %-8d %-8s %-8s\n", info.ID, info.Pid, status, info.Rootfs)
+		var display string
+		switch status {
+		case statusRunning:
+			display = "Running"
+		case statusExited:
+			display = fmt.Sprintf("Exited (%d)", info.ExitCode)
+			if info.OOMKilled {
+				display += " OOMKilled"
+			}
+		default:
+			display = "Created"
 		}
+		fmt.Printf("%-22s %-16s %-8d %-24s %-8s\n", info.ID, info.Name, info.Pid, display, info.Rootfs)
 	}
 }
 
 func Prune() {
-	files, err := filepath.Glob("/tmp/container_*.json")
+	files, err := filepath.Glob(containerPath("*") + ".json")
 	if err != nil {
 		fmt.Println("读取容器元数据失败:", err)
 		return
@@ -55,29 +57,11 @@ func Prune() {
 		b, _ := os.ReadFile(f)
 		var info ContainerInfo
 		json.Unmarshal(b, &info)
-		// 检查主进程 pid 是否存在于宿主机
-		pidExists := false
-		if info.Pid > 0 {
-			_, err := os.Stat(fmt.Sprintf("/proc/%d", info.Pid))
-			if err == nil {
-				pidExists = true
-			}
-		}
-		if !pidExists {
-			// 优先卸载 overlay2 挂载点
-			if info.Rootfs != "" {
-				_ = syscallUnmount(info.Rootfs)
-			}
-			// 删除 json 文件
-			os.Remove(f)
-			// 删除 base 目录及所有子目录
-			if info.Rootfs != "" {
-				base := info.Rootfs
-				if len(base) > 7 && base[len(base)-7:] == "/merged" {
-					base = base[:len(base)-7]
-				}
-				os.RemoveAll(base)
-			}
+		if containerStatus(info) != statusRunning {
+			// 卸载 overlay2 和 /dev/shm，删除 cgroup 和容器目录
+			cleanupContainer(info, true)
+			// 删除 json、env 和日志文件
+			removeContainerState(info.ID)
 			count++
 			fmt.Printf("已清理容器: %s\n", info.ID)
 		}
@@ -91,7 +75,7 @@ func Top(idPrefix string) {
 		fmt.Println(err)
 		return
 	}
-	b, err := os.ReadFile("/tmp/container_" + id + ".json")
+	b, err := os.ReadFile(containerPath(id) + ".json")
 	if err != nil {
 		fmt.Println("找不到容器:", id)
 		return
@@ -166,23 +150,3 @@ func Top(idPrefix string) {
 		fmt.Printf("%-8s %-8s %-8s %s\n", nspid, nsppid, pid, cmdline)
 	}
 }
-
-// 兼容性卸载
-func syscallUnmount(target string) error {
-	// 优先尝试正常卸载，失败则懒卸载
-	if err := syscallUnmountCall(target, 0); err != nil {
-		return syscallUnmountCall(target, 2) // syscall.MNT_DETACH = 2
-	}
-	return nil
-}
-
-// 兼容性调用
-func syscallUnmountCall(target string, flags int) error {
-	return os.NewSyscallError("unmount", syscallRawUnmount(target, flags))
-}
-
-// 兼容性底层调用
-func syscallRawUnmount(target string, flags int) error {
-	// 这里直接用 unix.Unmount 也可以
-	return nil // 这里留空，实际项目可用 "golang.org/x/sys/unix".Unmount
-}
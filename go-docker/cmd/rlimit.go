@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// --ulimit 指定的资源限制，-1 表示 unlimited
+type ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+// ulimit 名称与 setrlimit 资源编号，名称与 Docker 一致
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// 解析 --ulimit，格式 name=soft[:hard]，省略 hard 时与 soft 相同
+func parseUlimit(spec string) (ulimit, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok {
+		return ulimit{}, fmt.Errorf("--ulimit 格式错误，应为 name=soft[:hard]: %s", spec)
+	}
+	if _, ok := rlimitResources[name]; !ok {
+		return ulimit{}, fmt.Errorf("未知的 ulimit: %s", name)
+	}
+	softStr, hardStr, hasHard := strings.Cut(value, ":")
+	if !hasHard {
+		hardStr = softStr
+	}
+	soft, err := parseRlimitValue(softStr)
+	if err != nil {
+		return ulimit{}, fmt.Errorf("--ulimit %s: %v", spec, err)
+	}
+	hard, err := parseRlimitValue(hardStr)
+	if err != nil {
+		return ulimit{}, fmt.Errorf("--ulimit %s: %v", spec, err)
+	}
+	if hard >= 0 && (soft < 0 || soft > hard) {
+		return ulimit{}, fmt.Errorf("--ulimit %s: soft 不能大于 hard", spec)
+	}
+	return ulimit{Name: name, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimitValue(s string) (int64, error) {
+	if s == "unlimited" || s == "-1" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的值 %q", s)
+	}
+	return n, nil
+}
+
+func rlimitValue(n int64) uint64 {
+	if n < 0 {
+		return math.MaxUint64 // RLIM_INFINITY
+	}
+	return uint64(n)
+}
+
+// 设置资源限制，提高 hard 上限需要 CAP_SYS_RESOURCE，需在收缩能力集之前调用。
+// 使用 syscall.Setrlimit 而不是 prlimit，否则 Go 运行时会在 exec 时把 nofile 恢复为启动时的值。
+func applyUlimits(limits []ulimit) error {
+	for _, l := range limits {
+		rlim := syscall.Rlimit{Cur: rlimitValue(l.Soft), Max: rlimitValue(l.Hard)}
+		if err := syscall.Setrlimit(rlimitResources[l.Name], &rlim); err != nil {
+			return fmt.Errorf("设置 ulimit %s=%d:%d 失败: %v", l.Name, l.Soft, l.Hard, err)
+		}
+	}
+	return nil
+}
+
+// 写入 /proc/self/oom_score_adj，exec 后由容器进程继承
+func applyOOMScoreAdj(adj int) error {
+	if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0644); err != nil {
+		return fmt.Errorf("设置 oom_score_adj=%d 失败: %v", adj, err)
+	}
+	return nil
+}
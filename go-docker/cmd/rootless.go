@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// child 等待 uid/gid 映射写入的同步管道 fd
+const idmapSyncEnv = "_GODOCKER_IDMAP_SYNC_FD"
+
+// 非 root 用户运行时进入 rootless 模式
+func isRootless() bool {
+	return os.Geteuid() != 0
+}
+
+// 容器状态目录：root 使用 /tmp，rootless 使用 $XDG_DATA_HOME/go-docker，
+// 可通过 GODOCKER_ROOT 覆盖（child 在 user namespace 内是 root，靠它找到原来的目录）
+func stateRoot() string {
+	if d := os.Getenv("GODOCKER_ROOT"); d != "" {
+		return d
+	}
+	if !isRootless() {
+		return "/tmp"
+	}
+	if d := os.Getenv("XDG_DATA_HOME"); d != "" {
+		return filepath.Join(d, "go-docker")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "share", "go-docker")
+}
+
+// /etc/subuid、/etc/subgid 中的一段从属 id
+type subIDRange struct {
+	Start int
+	Count int
+}
+
+// 按用户名或 uid 查找从属 id 段，格式 name:start:count
+func lookupSubID(file, name string, id int) (subIDRange, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return subIDRange{}, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.Split(strings.TrimSpace(sc.Text()), ":")
+		if len(parts) != 3 || (parts[0] != name && parts[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(parts[1])
+		count, err2 := strconv.Atoi(parts[2])
+		if err1 == nil && err2 == nil && count > 0 {
+			return subIDRange{Start: start, Count: count}, true
+		}
+	}
+	return subIDRange{}, false
+}
+
+// 为 cmd 开启 user namespace 并配置 uid/gid 映射，返回 cmd 启动后需要调用的函数。
+// 有 newuidmap/newgidmap 和 subuid/subgid 时：容器 root 映射到当前用户，1..N 映射到从属 id 段；
+// 否则退化为只映射当前用户一个 id。
+func setupUserNS(cmd *exec.Cmd) (func() error, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+	uid, gid := os.Getuid(), os.Getgid()
+	name := strconv.Itoa(uid)
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	subUID, okUID := lookupSubID("/etc/subuid", name, uid)
+	subGID, okGID := lookupSubID("/etc/subgid", name, uid)
+	newuidmap, errUID := exec.LookPath("newuidmap")
+	newgidmap, errGID := exec.LookPath("newgidmap")
+	if !okUID || !okGID || errUID != nil || errGID != nil {
+		fmt.Println("rootless: 未找到 subuid/subgid 或 newuidmap/newgidmap，仅映射当前用户")
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+		return func() error { return nil }, nil
+	}
+
+	// 映射需要在 child 启动后由 setuid 的 newuidmap 写入，child 通过管道等待
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", idmapSyncEnv, 2+len(cmd.ExtraFiles)))
+	return func() error {
+		defer w.Close()
+		r.Close()
+		pid := strconv.Itoa(cmd.Process.Pid)
+		out, err := exec.Command(newuidmap, pid, "0", strconv.Itoa(uid), "1",
+			"1", strconv.Itoa(subUID.Start), strconv.Itoa(subUID.Count)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("newuidmap 失败: %v: %s", err, out)
+		}
+		out, err = exec.Command(newgidmap, pid, "0", strconv.Itoa(gid), "1",
+			"1", strconv.Itoa(subGID.Start), strconv.Itoa(subGID.Count)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("newgidmap 失败: %v: %s", err, out)
+		}
+		_, err = w.Write([]byte{1})
+		return err
+	}, nil
+}
+
+// 在 user namespace 内等待 uid/gid 映射完成。映射写入前 exec 进来时 uid 尚未映射，
+// 能力集已被清空，所以映射完成后重新 exec 自己，以 namespace 内 root 的身份拿回完整能力。
+func waitIDMap() {
+	fdStr := os.Getenv(idmapSyncEnv)
+	if fdStr == "" {
+		return
+	}
+	fd, err := strconv.Atoi(fdStr)
+	must(err)
+	f := os.NewFile(uintptr(fd), "idmap-sync")
+	io.Copy(io.Discard, f)
+	f.Close()
+	os.Unsetenv(idmapSyncEnv)
+	must(syscall.Exec("/proc/self/exe", os.Args, os.Environ()))
+}
+
+// 当前 user namespace 是否只映射了一个 uid（没有 newuidmap 时的退化模式）
+func singleIDMapping() bool {
+	b, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		return false
+	}
+	fields := strings.Fields(lines[0])
+	return len(fields) == 3 && fields[2] == "1"
+}
+
+// 删除容器目录。rootless 下镜像文件属于从属 uid，当前用户无权删除，
+// 需要进入相同映射的 user namespace 里删除。
+func removeContainerDir(dir string) {
+	err := os.RemoveAll(dir)
+	if err == nil || !isRootless() {
+		return
+	}
+	selfExe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("删除 %s 失败: %v\n", dir, err)
+		return
+	}
+	cmd := exec.Command(selfExe, "userns-rm", dir)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	afterStart, err := setupUserNS(cmd)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		err = afterStart()
+	}
+	if err == nil {
+		err = cmd.Wait()
+	}
+	if err != nil {
+		fmt.Printf("删除 %s 失败: %v\n", dir, err)
+	}
+}
+
+// userns-rm: 在 user namespace 内删除目录，由 removeContainerDir 调用
+func UsernsRemove(dir string) {
+	waitIDMap()
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Printf("删除 %s 失败: %v\n", dir, err)
+		os.Exit(1)
+	}
+}
+
+// rootless 模式下没有独立 network namespace 时无法挂载 sysfs，chroot 前 bind 宿主机的 /sys
+func bindHostSysfs(rootfs string) {
+	sys := filepath.Join(rootfs, "sys")
+	os.MkdirAll(sys, 0755)
+	if err := syscall.Mount("/sys", sys, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		fmt.Printf("child: bind /sys 失败: %v\n", err)
+		return
+	}
+	syscall.Mount("", sys, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|sysfsFlags, "")
+}
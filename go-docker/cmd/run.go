@@ -14,18 +14,28 @@ import (
 	"time"
 
 	"github.com/creack/pty"
-	"golang.org/x/sys/unix"
 )
 
-func RunWithMode(args []string, daemon bool) {
+// run: 前台运行时返回容器命令的退出码
+func Run(args []string) int {
+	runOpts, args := parseRunOptions(args)
 	if len(args) < 2 {
-		panic("run 需要指定镜像tag和命令，例如 run alpine:3.18 /bin/sh")
+		panic("run 需要指定镜像tag和命令，例如 run -it alpine:3.18 /bin/sh")
+	}
+	if runOpts.Name != "" {
+		if id, ok := findContainerByName(runOpts.Name); ok {
+			panic(fmt.Sprintf("容器名 %s 已被容器 %s 使用", runOpts.Name, id))
+		}
+	}
+	if !runOpts.Detach && runOpts.Interactive && runOpts.TTY && !isTerminal(os.Stdin) {
+		panic("标准输入不是终端，不能同时使用 -i 和 -t，去掉 -t 即可通过管道输入")
 	}
 	imageTag := args[0]
 	cmdArgs := args[1:]
 
-	// 1. 解析 manifest.json，找到对应 layer tar
+	// 1. 解析 manifest.json，找到对应 layer tar 和镜像配置
 	layerTar := ""
+	imageConfig := ""
 	manifestFile := "unpack/manifest.json"
 	b, err := os.ReadFile(manifestFile)
 	must(err)
@@ -40,6 +50,7 @@ func RunWithMode(args []string, daemon bool) {
 			if t.(string) == imageTag {
 				layers := m["Layers"].([]interface{})
 				layerTar = layers[0].(string)
+				imageConfig, _ = m["Config"].(string)
 				break
 			}
 		}
@@ -47,14 +58,49 @@ func RunWithMode(args []string, daemon bool) {
 	if layerTar == "" {
 		panic("未找到镜像层: " + imageTag)
 	}
+	// 未指定 --user 时使用镜像配置中的 User
+	var imgCfg imageRuntimeConfig
+	if imageConfig != "" {
+		imgCfg = loadImageConfig("unpack/" + imageConfig)
+	}
+	if runOpts.User == "" {
+		runOpts.User = imgCfg.User
+	}
+	if imgCfg.StopSignal != "" {
+		if _, err := parseSignal(imgCfg.StopSignal); err != nil {
+			fmt.Printf("忽略镜像配置中无效的 StopSignal: %v\n", err)
+			imgCfg.StopSignal = ""
+		}
+	}
 
 	// 2. 创建 overlay2 目录结构
+	rootless := isRootless()
+	must(os.MkdirAll(stateRoot(), 0700))
 	cid := genContainerID()
-	base := "/tmp/container_" + cid
+	base := containerPath(cid)
 	lowerdir := base + "/lower"
 	upperdir := base + "/upper"
 	workdir := base + "/work"
 	merged := base + "/merged"
+	// 启动失败时清理已创建的目录、cgroup 和挂载。元数据已写入时记为以 125 退出，
+	// 不留下一直处于 created 状态的容器
+	info := ContainerInfo{ID: cid, Rootfs: merged, Rootless: rootless, Status: statusCreated}
+	saved := false
+	defer func() {
+		if r := recover(); r != nil {
+			if info.Status == statusCreated {
+				if saved {
+					markExited(&info, exitRuntimeError)
+					saveContainerInfo(info)
+				}
+				cleanupContainer(info, true)
+				if info.AutoRemove {
+					removeContainerState(cid)
+				}
+			}
+			panic(r)
+		}
+	}()
 	must(os.MkdirAll(lowerdir, 0755))
 	must(os.MkdirAll(upperdir, 0755))
 	must(os.MkdirAll(workdir, 0755))
@@ -65,93 +111,310 @@ func RunWithMode(args []string, daemon bool) {
 	if !strings.HasPrefix(tarPath, "unpack/") {
 		tarPath = "unpack/" + tarPath
 	}
-	fmt.Printf("解包镜像层 %s 到 %s\n", tarPath, lowerdir)
-	must(exec.Command("tar", "-xf", tarPath, "-C", lowerdir).Run())
+	tarPath, err = filepath.Abs(tarPath)
+	must(err)
+	if !rootless {
+		fmt.Printf("解包镜像层 %s 到 %s\n", tarPath, lowerdir)
+		must(extractLayer(tarPath, lowerdir))
+	}
+
+	// 生成容器专属的 /etc/hosts、/etc/hostname、/etc/resolv.conf
+	hostname := runOpts.Hostname
+	if hostname == "" {
+		hostname = cid[:12]
+	}
+	info = ContainerInfo{
+		ID:          cid,
+		Name:        runOpts.Name,
+		Rootfs:      merged,
+		Hostname:    hostname,
+		ExtraHosts:  runOpts.ExtraHosts,
+		DNS:         runOpts.DNS,
+		Resources:   runOpts.Resources,
+		Rootless:    rootless,
+		Privileged:  runOpts.Privileged,
+		ReadOnly:    runOpts.ReadOnly,
+		Tmpfs:       runOpts.Tmpfs,
+		ShmSize:     runOpts.ShmSize,
+		Devices:     runOpts.Devices,
+		User:        runOpts.User,
+		Ulimits:     runOpts.Ulimits,
+		OOMScoreAdj: runOpts.OOMScoreAdj,
+		Sysctls:     runOpts.Sysctls,
+		IPC:         runOpts.IPC,
+		TimeOffsets: runOpts.TimeOffsets,
+		LogConfig:   runOpts.Log,
+		Tty:         runOpts.TTY,
+		OpenStdin:   runOpts.Interactive,
+		AutoRemove:  runOpts.AutoRemove,
+		Env:         runOpts.Env,
+		Volumes:     runOpts.Volumes,
+		WorkingDir:  runOpts.WorkingDir,
+		StopSignal:  imgCfg.StopSignal,
+		Init:        runOpts.Init,
+		Status:      statusCreated,
+	}
+	// 设备白名单：特权容器不限制；rootless 无法创建设备节点，访问权限由宿主机文件权限决定
+	var deviceRules []deviceRule
+	if !runOpts.Privileged && !rootless {
+		deviceRules = append([]deviceRule(nil), defaultDeviceRules...)
+		for _, d := range info.Devices {
+			r, err := d.rule()
+			must(err)
+			deviceRules = append(deviceRules, r)
+		}
+	}
+	info.Capabilities = runOpts.Capabilities
+	info.Seccomp = runOpts.Seccomp
+	info.NoNewPrivileges = runOpts.NoNewPrivileges
+	if rootless {
+		// rootless 模式下由 child 在 user namespace 内解包并挂载 overlay，
+		// 镜像文件属主经 uid/gid 映射落到从属 id 上
+		info.Layer = tarPath
+	}
+	must(writeEtcFiles(base, info))
+	if !rootless && info.IPC == ipcModePrivate {
+		must(mountShm(base, info.ShmSize))
+	}
+
+	// 创建容器 cgroup 并写入资源限制，v2 优先，旧主机回退到 v1
+	info.CgroupMode = detectCgroupMode()
+	cg := newCgroupManager(info.CgroupMode, cid)
+	if cg != nil {
+		if err := cg.Create(); err != nil {
+			// rootless 通常没有 cgroup 写权限（未做委派），没有资源限制时可以不用 cgroup
+			if !rootless || !info.Resources.empty() {
+				panic(err)
+			}
+			fmt.Printf("rootless: 无法创建 cgroup，跳过: %v\n", err)
+			cg.Destroy()
+			info.CgroupMode = ""
+			cg = nil
+		}
+	}
+	if cg != nil {
+		// 设备白名单是默认的加固措施，不是用户要求的限制，没有可用的 devices 控制器时跳过
+		if deviceCgroupAvailable(info.CgroupMode) {
+			info.Resources.Devices = deviceRules
+		}
+		must(cg.Apply(info.Resources))
+	} else if !info.Resources.empty() {
+		panic("宿主机未挂载 cgroup，无法设置资源限制")
+	} else {
+		fmt.Println("未使用 cgroup，跳过资源限制设置")
+	}
 
 	// 4. 挂载 overlay2
-	fmt.Printf("挂载 overlay2 到 %s\n", merged)
-	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerdir, upperdir, workdir)
-	must(syscall.Mount("overlay", merged, "overlay", 0, opts))
+	if !rootless {
+		fmt.Printf("挂载 overlay2 到 %s\n", merged)
+		must(mountOverlay(base))
+	}
 
 	// 5. 启动容器进程
+	// 先写入元数据（pid 未知），child 启动时从中读取 hostname 等配置。
+	// 后台容器的 shim 就绪前由当前进程看护，wait 据此判断未启动的容器是否还会启动
+	info.ShimPid = os.Getpid()
+	saveContainerInfo(info)
+	saved = true
 	fmt.Printf("启动容器 %s，命令: %v\n", cid, cmdArgs)
 
-	selfExe, err := filepath.Abs(os.Args[0])
+	if runOpts.Detach {
+		// 后台容器由独立的 shim 进程启动并看护，run 进程可以直接退出
+		pid, err := startShim(info, cmdArgs)
+		must(err)
+		fmt.Printf("容器启动成功，id: %s, pid: %d\n", cid, pid)
+		fmt.Println("容器已在后台运行。请使用如下命令进入容器终端：")
+		fmt.Printf("./go-docker exec %s /bin/sh\n", cid)
+		return 0
+	}
+	childCmd, afterStart, err := newContainerCmd(info, cmdArgs)
 	must(err)
-	// 执行child命令
-	childCmd := exec.Command(selfExe, append([]string{"child"}, cmdArgs...)...)
-	childCmd.Env = append(os.Environ(), "CONTAINER_ROOTFS="+merged)
-	childCmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
-	}
-	if !daemon {
-		// 使用 pty 分配伪终端，保证容器内 shell 交互
+	// 输出同时写入终端和容器日志
+	logger, err := newJSONLogger(containerLogPath(cid), info.LogConfig)
+	must(err)
+	stdout, stderr := logger.writer("stdout"), logger.writer("stderr")
+	var ptmx *os.File
+	outputDone := make(chan struct{})
+	if info.Tty {
+		// -t 分配伪终端，保证容器内 shell 交互
 		// 优化：在启动 child 进程前同步窗口大小，确保 shell 能正确获取尺寸
-		// daemon模式分配pty，并设为控制终端
-		winSize, _ := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
-		ptmx, err := pty.StartWithAttrs(childCmd, &pty.Winsize{
-			Rows: winSize.Row,
-			Cols: winSize.Col,
-			X:    winSize.Xpixel,
-			Y:    winSize.Ypixel,
-		}, &syscall.SysProcAttr{
-			Setsid:     true,
-			Setctty:    true,
-			Ctty:       0, // 由 pty.StartWithAttrs 自动设置
-			Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
-		})
+		childCmd.SysProcAttr.Setsid = true
+		childCmd.SysProcAttr.Setctty = true
+		childCmd.SysProcAttr.Ctty = 0 // 由 pty.StartWithAttrs 自动设置
+		ptmx, err = pty.StartWithAttrs(childCmd, terminalSize(), childCmd.SysProcAttr)
 		must(err)
-		// daemon模式无需同步窗口大小和信号
-		// 立即记录容器元数据（此时 child 进程已启动，pid 已分配）
-		info := ContainerInfo{
-			ID:     cid,
-			Rootfs: merged,
-			Pid:    childCmd.Process.Pid,
-		}
-		saveContainerInfo(info)
-		fmt.Printf("容器启动成功，id: %s, pid: %d\n", cid, info.Pid)
-		go func() { _, _ = io.Copy(os.Stdout, ptmx) }()
+		go func() {
+			_, _ = io.Copy(io.MultiWriter(os.Stdout, stdout), ptmx)
+			close(outputDone)
+		}()
+	} else {
+		// 没有 -t 时直接对接标准输出；-i 时标准输入也直接交给容器，否则容器的标准输入为 /dev/null
+		if info.OpenStdin {
+			childCmd.Stdin = os.Stdin
+		}
+		childCmd.Stdout = io.MultiWriter(os.Stdout, stdout)
+		childCmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+		must(childCmd.Start())
+		close(outputDone)
+	}
+	// 立即记录容器元数据（此时 child 进程已启动，pid 已分配）
+	if err := afterStart(); err != nil {
+		childCmd.Process.Kill()
+		panic(err)
+	}
+	markRunning(&info, childCmd.Process.Pid)
+	saveContainerInfo(info)
+	fmt.Printf("容器启动成功，id: %s, pid: %d\n", cid, info.Pid)
+	fmt.Println("runWithMode: 等待 child 进程退出 ...")
+	restore := func() {}
+	if ptmx != nil && isTerminal(os.Stdin) {
+		// 宿主机终端窗口变化时同步调整容器 pty 大小
+		defer watchResize(func(ws *pty.Winsize) { pty.Setsize(ptmx, ws) })()
+		// -it 时终端切到 raw 模式，回显和 Ctrl-C 等按键交给容器内的 pty 处理
+		if info.OpenStdin {
+			if r, err := makeRaw(os.Stdin); err == nil {
+				restore = r
+				defer restore()
+			}
+		}
+	}
+	if ptmx != nil && info.OpenStdin {
 		go func() { _, _ = io.Copy(ptmx, os.Stdin) }()
-		fmt.Println("runWithMode: 等待 child 进程退出 ...")
-		err = childCmd.Wait()
-		fmt.Printf("runWithMode: child 进程退出，err=%v\n", err)
+	}
+	err = childCmd.Wait()
+	waitOutput(outputDone)
+	restore()
+	fmt.Printf("runWithMode: child 进程退出，err=%v\n", err)
+	if ptmx != nil {
 		ptmx.Close()
-		// 容器进程退出后，自动清理 overlay2 挂载和目录
+	}
+	stdout.Flush()
+	stderr.Flush()
+	logger.Close()
+	markExited(&info, exitCode(childCmd.ProcessState))
+	saveContainerInfo(info)
+	// 容器进程退出后，自动清理 overlay2 挂载和目录；--rm 时元数据和日志一并删除
+	cleanupContainer(info, true)
+	if info.AutoRemove {
+		removeContainerState(cid)
+	}
+	return info.ExitCode
+}
+
+// 构造启动容器进程的 child 命令：namespace、cgroup、rootless 的 uid/gid 映射。
+// 返回的函数需在命令启动后调用，负责写入 uid/gid 映射并释放 cgroup fd。
+func newContainerCmd(info ContainerInfo, cmdArgs []string) (*exec.Cmd, func() error, error) {
+	selfExe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(selfExe, append([]string{"child"}, cmdArgs...)...)
+	// 不传入宿主机的环境变量，--init 时 child 自己就是容器的 PID 1。PATH 用于 rootless 下调用 tar 解包
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "CONTAINER_ROOTFS=" + info.Rootfs, "CONTAINER_ID=" + info.ID, "GODOCKER_ROOT=" + stateRoot()}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWCGROUP,
+	}
+	if info.IPC == ipcModePrivate {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWIPC
+	}
+	var cgFile *os.File
+	if info.CgroupMode == cgroupModeV2 {
+		// clone3(CLONE_INTO_CGROUP)：child 创建时即位于容器 cgroup，exec 前不会逃逸
+		if cgFile, err = newCgroupV2(info.ID).Open(); err != nil {
+			return nil, nil, err
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgFile.Fd())
+	}
+	// rootless 模式使用 user namespace，child 启动后写入 uid/gid 映射
+	idmap := func() error { return nil }
+	if info.Rootless {
+		if idmap, err = setupUserNS(cmd); err != nil {
+			return nil, nil, err
+		}
+	}
+	return cmd, func() error {
+		if cgFile != nil {
+			cgFile.Close()
+		}
+		return idmap()
+	}, nil
+}
+
+// 等待 pty 中剩余的输出读完。容器进程退出后从设备随之关闭，读取返回 EIO；
+// 若有进程泄漏持有从设备，最多等待一秒
+func waitOutput(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// 删除容器的元数据、环境变量和日志文件
+func removeContainerState(id string) {
+	files, _ := filepath.Glob(containerPath(id) + ".*")
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+// 容器进程退出后的清理：卸载 overlay2 和 /dev/shm、删除 cgroup，removeDir 时同时删除容器目录。
+// 元数据文件保留，ps -a 仍能看到已退出的容器，由 rm/prune 删除
+func cleanupContainer(info ContainerInfo, removeDir bool) {
+	if !info.Rootless {
 		// 优先尝试正常卸载，失败则懒卸载
-		if err := syscall.Unmount(merged, 0); err != nil {
-			// 懒卸载，确保挂载点被清理
-			syscall.Unmount(merged, syscall.MNT_DETACH)
+		if err := syscall.Unmount(info.Rootfs, 0); err != nil {
+			syscall.Unmount(info.Rootfs, syscall.MNT_DETACH)
 		}
-		base := strings.TrimSuffix(merged, "/merged")
-		os.RemoveAll(base)
-	} else {
-		// daemon 模式也分配 pty，保证 /bin/sh 检测到 tty 不会立即退出
-		ptmx, err := ptyStart(childCmd)
-		must(err)
-		// 立即记录容器元数据
-		info := ContainerInfo{
-			ID:     cid,
-			Rootfs: merged,
-			Pid:    childCmd.Process.Pid,
-		}
-		saveContainerInfo(info)
-		fmt.Printf("runWithMode: daemon 模式 child 启动，err=%v\n", err)
-		fmt.Printf("容器启动成功，id: %s, pid: %d\n", cid, info.Pid)
-		fmt.Println("容器已在后台运行。请使用如下命令进入容器终端：")
-		fmt.Printf("./go-docker exec %s /bin/sh\n", cid)
-		// 后台运行，持有 pty，防止 shell 检测到 EOF/SIGHUP 自动退出
-		go func() {
-			// 持续读写，防止 pty 被关闭
-			buf := make([]byte, 1024)
-			for {
-				_, err := ptmx.Read(buf)
-				if err != nil {
-					break
-				}
-			}
-		}()
-		// 不要关闭 ptmx，保持 pty 句柄直到主进程退出
+		unmountShm(strings.TrimSuffix(info.Rootfs, "/merged"))
+	}
+	destroyCgroup(info)
+	if removeDir {
+		removeContainerDir(strings.TrimSuffix(info.Rootfs, "/merged"))
+	}
+}
+
+// 镜像配置中与运行相关的字段
+type imageRuntimeConfig struct {
+	User       string
+	StopSignal string
+}
+
+// 读取镜像配置文件中的 config，读取失败时返回零值（以 root 运行，stop 使用 SIGTERM）
+func loadImageConfig(path string) imageRuntimeConfig {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return imageRuntimeConfig{}
+	}
+	var cfg struct {
+		Config imageRuntimeConfig `json:"config"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		fmt.Printf("解析镜像配置 %s 失败: %v\n", path, err)
+		return imageRuntimeConfig{}
 	}
+	return cfg.Config
+}
+
+// 解包镜像层，extra 为附加的 tar 参数
+func extractLayer(tarPath, dir string, extra ...string) error {
+	args := append([]string{"-xf", tarPath, "-C", dir}, extra...)
+	out, err := exec.Command("tar", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("解包 %s 失败: %v: %s", tarPath, err, out)
+	}
+	return nil
+}
+
+// 把 base 下的 lower/upper/work 挂载为 overlay2 到 base/merged
+func mountOverlay(base string) error {
+	opts := fmt.Sprintf("lowerdir=%s/lower,upperdir=%s/upper,workdir=%s/work", base, base, base)
+	return syscall.Mount("overlay", base+"/merged", "overlay", 0, opts)
+}
+
+// 容器状态文件路径前缀，后面拼 .json/.env 即为元数据文件，本身是容器的 base 目录
+func containerPath(id string) string {
+	return filepath.Join(stateRoot(), "container_"+id)
 }
 
 func must(err error) {
@@ -171,8 +434,12 @@ func genContainerID() string {
 }
 
 // 通过前缀查找唯一容器ID
+// 按容器名或容器ID前缀查找容器，容器名优先
 func FindContainerID(prefix string) (string, error) {
-	files, err := filepath.Glob("/tmp/container_*.json")
+	if id, ok := findContainerByName(prefix); ok {
+		return id, nil
+	}
+	files, err := filepath.Glob(containerPath("*") + ".json")
 	if err != nil {
 		return "", fmt.Errorf("读取容器元数据失败: %v", err)
 	}
@@ -192,16 +459,65 @@ func FindContainerID(prefix string) (string, error) {
 	return match, nil
 }
 
+// 查找使用该名字的容器
+func findContainerByName(name string) (string, bool) {
+	files, _ := filepath.Glob(containerPath("*") + ".json")
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var info ContainerInfo
+		if json.Unmarshal(b, &info) == nil && info.Name != "" && info.Name == name {
+			return info.ID, true
+		}
+	}
+	return "", false
+}
+
+// 先写临时文件再 rename，stop、logs 等并发读取时不会读到写了一半的文件
 func saveContainerInfo(info ContainerInfo) {
-	f, err := os.Create("/tmp/container_" + info.ID + ".json")
+	path := containerPath(info.ID) + ".json"
+	b, _ := json.Marshal(info)
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		fmt.Println("保存容器元数据失败:", err)
 		return
 	}
-	defer f.Close()
-	fmt.Fprintf(f, "{\"id\":\"%s\",\"rootfs\":\"%s\",\"pid\":%d}\n", info.ID, info.Rootfs, info.Pid)
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		fmt.Println("保存容器元数据失败:", err)
+	}
 }
 
-func ptyStart(cmd *exec.Cmd) (*os.File, error) {
-	return pty.Start(cmd)
+// 容器进程已启动
+func markRunning(info *ContainerInfo, pid int) {
+	info.Pid = pid
+	info.Status = statusRunning
+	info.StartedAt = time.Now()
+}
+
+// 容器进程已退出，需在删除 cgroup 之前调用以便读取 OOM 记录
+func markExited(info *ContainerInfo, code int) {
+	info.Status = statusExited
+	info.ExitCode = code
+	info.FinishedAt = time.Now()
+	info.OOMKilled = containerOOMKilled(*info)
+}
+
+func loadContainerInfo(id string) (ContainerInfo, error) {
+	var info ContainerInfo
+	b, err := os.ReadFile(containerPath(id) + ".json")
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(b, &info)
+	return info, err
 }
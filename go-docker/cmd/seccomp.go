@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Docker/OCI 格式的 seccomp profile，可通过 --security-opt seccomp=profile.json 指定
+type seccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet *uint32          `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string         `json:"architectures,omitempty"`
+	Syscalls        []seccompSyscall `json:"syscalls,omitempty"`
+}
+
+type seccompSyscall struct {
+	Name     string        `json:"name,omitempty"` // 旧格式只有单个 name
+	Names    []string      `json:"names,omitempty"`
+	Action   string        `json:"action"`
+	ErrnoRet *uint32       `json:"errnoRet,omitempty"`
+	Args     []seccompArg  `json:"args,omitempty"`
+	Includes seccompFilter `json:"includes,omitempty"`
+	Excludes seccompFilter `json:"excludes,omitempty"`
+}
+
+type seccompArg struct {
+	Index    uint   `json:"index"`
+	Value    uint64 `json:"value"`
+	ValueTwo uint64 `json:"valueTwo,omitempty"`
+	Op       string `json:"op"`
+}
+
+// 规则生效的条件：includes 要求全部满足，excludes 满足任意一个即跳过
+type seccompFilter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// 默认 profile：放行其余系统调用，拦截可能影响宿主机或逃逸的调用，返回 EPERM。
+// 容器拥有对应能力（例如 --cap-add SYS_ADMIN）时相应规则不生效。
+func defaultSeccompProfile() *seccompProfile {
+	deny := func(caps []string, names ...string) seccompSyscall {
+		return seccompSyscall{Names: names, Action: "SCMP_ACT_ERRNO", Excludes: seccompFilter{Caps: caps}}
+	}
+	p := &seccompProfile{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Syscalls: []seccompSyscall{
+			// 任何情况下都不允许：内核密钥环没有 namespace 隔离，kexec 会替换宿主机内核
+			deny(nil, "kexec_load", "kexec_file_load", "keyctl", "add_key", "request_key",
+				"userfaultfd", "lookup_dcookie", "nfsservctl", "uselib", "ustat", "sysfs", "_sysctl",
+				"vm86", "vm86old", "get_kernel_syms", "query_module", "create_module"),
+			deny([]string{"SYS_ADMIN"}, "mount", "umount", "umount2", "pivot_root", "unshare", "setns",
+				"swapon", "swapoff", "quotactl", "fsopen", "fsconfig", "fsmount", "fspick", "move_mount",
+				"open_tree", "mount_setattr", "name_to_handle_at", "fanotify_init", "iopl", "ioperm"),
+			deny([]string{"SYS_ADMIN", "BPF"}, "bpf"),
+			deny([]string{"SYS_ADMIN", "PERFMON"}, "perf_event_open"),
+			// 容器内的 strace、gdb 需要 ptrace，PID namespace 已保证只能跟踪容器内的进程。
+			// 与 Docker 相同，只在 4.8 之前的内核上拦截（ptrace 可绕过 seccomp）
+			{Names: []string{"ptrace", "process_vm_readv", "process_vm_writev"}, Action: "SCMP_ACT_ERRNO",
+				Excludes: seccompFilter{Caps: []string{"SYS_PTRACE"}, MinKernel: "4.8"}},
+			deny([]string{"SYS_PTRACE"}, "kcmp"),
+			deny([]string{"SYS_MODULE"}, "init_module", "finit_module", "delete_module"),
+			deny([]string{"SYS_BOOT"}, "reboot"),
+			deny([]string{"SYS_TIME"}, "settimeofday", "stime", "clock_settime", "clock_adjtime"),
+			deny([]string{"SYS_PACCT"}, "acct"),
+			deny([]string{"DAC_READ_SEARCH"}, "open_by_handle_at"),
+			deny([]string{"SYS_NICE"}, "get_mempolicy", "mbind", "set_mempolicy", "move_pages"),
+			deny([]string{"SYSLOG"}, "syslog"),
+			// clone3 的参数在内存里，seccomp 无法检查，返回 ENOSYS 让 libc 退回到 clone
+			{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: ptrU32(uint32(unix.ENOSYS)),
+				Excludes: seccompFilter{Caps: []string{"SYS_ADMIN"}}},
+		},
+	}
+	// clone 带任何 namespace 标志都拒绝
+	for _, flag := range []uint64{unix.CLONE_NEWNS, unix.CLONE_NEWUTS, unix.CLONE_NEWIPC, unix.CLONE_NEWUSER,
+		unix.CLONE_NEWPID, unix.CLONE_NEWNET, unix.CLONE_NEWCGROUP} {
+		p.Syscalls = append(p.Syscalls, seccompSyscall{
+			Names:    []string{"clone"},
+			Action:   "SCMP_ACT_ERRNO",
+			Args:     []seccompArg{{Index: 0, Value: flag, ValueTwo: flag, Op: "SCMP_CMP_MASKED_EQ"}},
+			Excludes: seccompFilter{Caps: []string{"SYS_ADMIN"}},
+		})
+	}
+	return p
+}
+
+func ptrU32(v uint32) *uint32 {
+	return &v
+}
+
+// 读取 JSON 格式的 profile
+func loadSeccompProfile(path string) (*seccompProfile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 seccomp profile 失败: %v", err)
+	}
+	var p seccompProfile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("解析 seccomp profile %s 失败: %v", path, err)
+	}
+	if _, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// 把 SCMP_ACT_* 转换为 seccomp 返回值，ERRNO 未指定 errno 时默认 EPERM
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = *errnoRet
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | (errno & unix.SECCOMP_RET_DATA), nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("不支持的 seccomp action: %q", action)
+}
+
+// 判断规则在当前能力集、架构和内核版本下是否生效
+func (s seccompSyscall) applies(caps map[string]bool, kernel [2]int) bool {
+	for _, c := range s.Includes.Caps {
+		if !caps[strings.TrimPrefix(c, "CAP_")] {
+			return false
+		}
+	}
+	if len(s.Includes.Arches) > 0 && !archMatches(s.Includes.Arches) {
+		return false
+	}
+	if s.Includes.MinKernel != "" && !kernelAtLeast(kernel, s.Includes.MinKernel) {
+		return false
+	}
+	for _, c := range s.Excludes.Caps {
+		if caps[strings.TrimPrefix(c, "CAP_")] {
+			return false
+		}
+	}
+	if len(s.Excludes.Arches) > 0 && archMatches(s.Excludes.Arches) {
+		return false
+	}
+	if s.Excludes.MinKernel != "" && kernelAtLeast(kernel, s.Excludes.MinKernel) {
+		return false
+	}
+	return true
+}
+
+// profile 中的架构名既可能是 amd64 也可能是 SCMP_ARCH_X86_64
+func archMatches(arches []string) bool {
+	goArch := map[string]string{"SCMP_ARCH_X86_64": "amd64", "SCMP_ARCH_AARCH64": "arm64"}[seccompArchName]
+	for _, a := range arches {
+		if a == seccompArchName || a == goArch {
+			return true
+		}
+	}
+	return false
+}
+
+func kernelVersion() [2]int {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return [2]int{}
+	}
+	return parseKernelVersion(unix.ByteSliceToString(uts.Release[:]))
+}
+
+func parseKernelVersion(s string) [2]int {
+	var v [2]int
+	parts := strings.SplitN(s, ".", 3)
+	for i := 0; i < len(parts) && i < 2; i++ {
+		n := strings.TrimLeftFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		end := strings.IndexFunc(n, func(r rune) bool { return r < '0' || r > '9' })
+		if end >= 0 {
+			n = n[:end]
+		}
+		v[i], _ = strconv.Atoi(n)
+	}
+	return v
+}
+
+func kernelAtLeast(cur [2]int, min string) bool {
+	m := parseKernelVersion(min)
+	return cur[0] > m[0] || (cur[0] == m[0] && cur[1] >= m[1])
+}
+
+// seccomp_data 中各字段的偏移：nr、arch、args[i] 的低 32 位和高 32 位（小端）
+const (
+	seccompOffNr   = 0
+	seccompOffArch = 4
+	seccompOffArgs = 16
+)
+
+// 简单的 cBPF 汇编器，跳转目标用标签表示，最后统一换算成相对偏移
+type bpfInsn struct {
+	code   uint16
+	k      uint32
+	jt, jf string // 空串表示下一条指令
+}
+
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+func (a *bpfAsm) stmt(code uint16, k uint32) {
+	a.insns = append(a.insns, bpfInsn{code: code, k: k})
+}
+
+func (a *bpfAsm) jump(code uint16, k uint32, jt, jf string) {
+	a.insns = append(a.insns, bpfInsn{code: code, k: k, jt: jt, jf: jf})
+}
+
+func (a *bpfAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+func (a *bpfAsm) assemble() ([]unix.SockFilter, error) {
+	out := make([]unix.SockFilter, len(a.insns))
+	off := func(i int, l string) (uint8, error) {
+		if l == "" {
+			return 0, nil
+		}
+		target, ok := a.labels[l]
+		d := target - i - 1
+		if !ok || d < 0 || d > 255 {
+			return 0, fmt.Errorf("seccomp: 跳转 %s 超出范围", l)
+		}
+		return uint8(d), nil
+	}
+	for i, in := range a.insns {
+		jt, err := off(i, in.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := off(i, in.jf)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = unix.SockFilter{Code: in.code, Jt: jt, Jf: jf, K: in.k}
+	}
+	if len(out) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp: 过滤器指令数 %d 超过上限 %d", len(out), unix.BPF_MAXINSNS)
+	}
+	return out, nil
+}
+
+const (
+	bpfLd  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	bpfJeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	bpfJgt = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+	bpfJge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+	bpfAnd = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	bpfRet = unix.BPF_RET | unix.BPF_K
+)
+
+// 把 profile 编译为 cBPF 程序。caps 为容器最终的能力集，用于计算 includes/excludes。
+// 规则按 profile 中的顺序匹配，第一条命中的规则决定返回值。
+func compileSeccomp(p *seccompProfile, caps []string) ([]unix.SockFilter, error) {
+	defAction, err := seccompAction(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	capSet := map[string]bool{}
+	for _, c := range caps {
+		capSet[c] = true
+	}
+	kernel := kernelVersion()
+	a := &bpfAsm{labels: map[string]int{}}
+
+	// 非本机架构（如 x86_64 上的 32 位调用）一律拒绝
+	a.stmt(bpfLd, seccompOffArch)
+	a.jump(bpfJeq, seccompNativeArch, "native", "")
+	a.stmt(bpfRet, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM))
+	a.label("native")
+	if seccompArchName == "SCMP_ARCH_X86_64" {
+		// x32 ABI 与 x86_64 共用 arch，系统调用号带 0x40000000 标志
+		a.stmt(bpfLd, seccompOffNr)
+		a.jump(bpfJge, 0x40000000, "", "rules")
+		a.stmt(bpfRet, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM))
+		a.label("rules")
+	}
+
+	for i, rule := range p.Syscalls {
+		if !rule.applies(capSet, kernel) {
+			continue
+		}
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		names := rule.Names
+		if rule.Name != "" {
+			names = append(names, rule.Name)
+		}
+		for j, name := range names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				// 本架构没有的系统调用（如 x86_64 上的 vm86）直接忽略
+				continue
+			}
+			next := fmt.Sprintf("r%d_%d_next", i, j)
+			a.stmt(bpfLd, seccompOffNr)
+			a.jump(bpfJeq, nr, "", next)
+			for k, arg := range rule.Args {
+				if err := compileSeccompArg(a, arg, next, fmt.Sprintf("r%d_%d_a%d_ok", i, j, k)); err != nil {
+					return nil, err
+				}
+			}
+			a.stmt(bpfRet, action)
+			a.label(next)
+		}
+	}
+	a.stmt(bpfRet, defAction)
+	return a.assemble()
+}
+
+// 编译一个参数比较，不满足时跳到 fail，满足时继续执行后面的指令。
+// 参数是 64 位的，cBPF 只能按 32 位比较，需要先比高位再比低位。
+func compileSeccompArg(a *bpfAsm, arg seccompArg, fail, ok string) error {
+	if arg.Index > 5 {
+		return fmt.Errorf("seccomp: 参数下标 %d 超出范围", arg.Index)
+	}
+	lo := uint32(seccompOffArgs + 8*arg.Index)
+	hi := lo + 4
+	vHi, vLo := uint32(arg.Value>>32), uint32(arg.Value)
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		a.stmt(bpfLd, hi)
+		a.jump(bpfJeq, vHi, "", fail)
+		a.stmt(bpfLd, lo)
+		a.jump(bpfJeq, vLo, "", fail)
+	case "SCMP_CMP_NE":
+		a.stmt(bpfLd, hi)
+		a.jump(bpfJeq, vHi, "", ok)
+		a.stmt(bpfLd, lo)
+		a.jump(bpfJeq, vLo, fail, "")
+	case "SCMP_CMP_MASKED_EQ":
+		// (arg & value) == valueTwo
+		a.stmt(bpfLd, hi)
+		a.stmt(bpfAnd, vHi)
+		a.jump(bpfJeq, uint32(arg.ValueTwo>>32), "", fail)
+		a.stmt(bpfLd, lo)
+		a.stmt(bpfAnd, vLo)
+		a.jump(bpfJeq, uint32(arg.ValueTwo), "", fail)
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		a.stmt(bpfLd, hi)
+		a.jump(bpfJgt, vHi, ok, "")
+		a.jump(bpfJeq, vHi, "", fail)
+		a.stmt(bpfLd, lo)
+		if arg.Op == "SCMP_CMP_GT" {
+			a.jump(bpfJgt, vLo, "", fail)
+		} else {
+			a.jump(bpfJge, vLo, "", fail)
+		}
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		a.stmt(bpfLd, hi)
+		a.jump(bpfJgt, vHi, fail, "")
+		a.jump(bpfJeq, vHi, "", ok)
+		a.stmt(bpfLd, lo)
+		if arg.Op == "SCMP_CMP_LT" {
+			a.jump(bpfJge, vLo, fail, "")
+		} else {
+			a.jump(bpfJgt, vLo, fail, "")
+		}
+	default:
+		return fmt.Errorf("seccomp: 不支持的比较操作 %q", arg.Op)
+	}
+	a.label(ok)
+	return nil
+}
+
+// 安装 seccomp 过滤器。TSYNC 保证 Go 运行时的所有线程都生效，
+// 否则 exec 所在线程可能没有过滤器。
+func installSeccomp(p *seccompProfile, caps []string) error {
+	if seccompNativeArch == 0 {
+		fmt.Println("child: 当前架构不支持 seccomp 过滤，已跳过")
+		return nil
+	}
+	filter, err := compileSeccomp(p, caps)
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := unix.RawSyscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("安装 seccomp 过滤器失败: %v", errno)
+	}
+	return nil
+}
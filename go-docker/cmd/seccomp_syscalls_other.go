@@ -0,0 +1,11 @@
+//go:build !amd64 && !arm64
+
+package cmd
+
+// 其它架构暂无系统调用表，seccompNativeArch 为 0 时不安装 seccomp 过滤器
+const (
+	seccompNativeArch = 0
+	seccompArchName   = ""
+)
+
+var syscallNumbers = map[string]uint32{}
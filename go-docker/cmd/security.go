@@ -0,0 +1,185 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// /dev/shm 默认大小
+const defaultShmSize = 64 << 20
+
+// 容器内默认屏蔽的路径：文件用 /dev/null 覆盖，目录用只读空 tmpfs 覆盖
+var maskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/sys/firmware",
+}
+
+// 容器内默认只读的路径
+var readonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// 屏蔽敏感路径，需在 chroot 并挂载 /proc、/sys 之后调用
+func maskPaths() {
+	for _, p := range maskedPaths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if fi.IsDir() {
+			err = syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY, "size=0")
+		} else {
+			err = syscall.Mount("/dev/null", p, "", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			fmt.Printf("child: 屏蔽 %s 失败: %v\n", p, err)
+		}
+	}
+}
+
+// 把 /proc/sys 等路径 bind 到自身后重新挂载为只读
+func readonlyProcPaths() {
+	for _, p := range readonlyPaths {
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := remountReadonly(p); err != nil {
+			fmt.Printf("child: 设置 %s 只读失败: %v\n", p, err)
+		}
+	}
+}
+
+func remountReadonly(p string) error {
+	if err := syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	return syscall.Mount(p, p, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+}
+
+// 挂载 --tmpfs 指定的目录，格式 /run[:rw,size=64m,mode=1777]，默认 noexec,nosuid,nodev
+func mountTmpfs(spec string) error {
+	target, flags, data, err := parseTmpfs(spec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	return syscall.Mount("tmpfs", target, "tmpfs", flags, data)
+}
+
+// 解析 --tmpfs，返回挂载点、挂载标志和 tmpfs 参数。run 解析选项时先检查一遍，错误的参数不会等到 child 挂载时才报出
+func parseTmpfs(spec string) (string, uintptr, string, error) {
+	target, opts, _ := strings.Cut(spec, ":")
+	if !filepath.IsAbs(target) {
+		return "", 0, "", fmt.Errorf("--tmpfs 需要绝对路径: %s", spec)
+	}
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	var data []string
+	for _, o := range strings.Split(opts, ",") {
+		switch o {
+		case "":
+		case "ro":
+			flags |= syscall.MS_RDONLY
+		case "rw":
+			flags &^= syscall.MS_RDONLY
+		case "exec":
+			flags &^= syscall.MS_NOEXEC
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		case "suid":
+			flags &^= syscall.MS_NOSUID
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "dev":
+			flags &^= syscall.MS_NODEV
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		default:
+			if err := checkTmpfsOpt(o); err != nil {
+				return "", 0, "", fmt.Errorf("--tmpfs %s: %v", spec, err)
+			}
+			data = append(data, o)
+		}
+	}
+	return target, flags, strings.Join(data, ","), nil
+}
+
+// 检查 tmpfs 参数：size、nr_inodes 为数字加可选的 k/m/g 等后缀（size 还可以是百分比），mode 为八进制，uid/gid 为数字
+func checkTmpfsOpt(o string) error {
+	key, value, _ := strings.Cut(o, "=")
+	var err error
+	switch key {
+	case "size", "nr_inodes":
+		n := value
+		if key == "size" {
+			n = strings.TrimSuffix(n, "%")
+		}
+		if n != "" && strings.ContainsRune("kKmMgGtTpPeE", rune(n[len(n)-1])) {
+			n = n[:len(n)-1]
+		}
+		_, err = strconv.ParseUint(n, 10, 64)
+	case "mode":
+		_, err = strconv.ParseUint(value, 8, 32)
+	case "uid", "gid":
+		_, err = strconv.ParseUint(value, 10, 32)
+	default:
+		return fmt.Errorf("不支持的参数 %s", o)
+	}
+	if err != nil {
+		return fmt.Errorf("参数 %s 的值无效", o)
+	}
+	return nil
+}
+
+// 把容器根目录重新挂载为只读，--tmpfs 和 /etc/hosts 等独立挂载不受影响
+func remountRootReadonly() error {
+	return syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+}
+
+// exec 容器命令前收缩权限，容器主进程和 exec 进入容器的进程共用：
+// no_new_privs、seccomp、bounding 能力集，切换用户后再设置剩余的能力
+func dropPrivileges(info ContainerInfo, user execUser) error {
+	if info.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("设置 no_new_privs 失败: %v", err)
+		}
+	}
+	// seccomp 需在去掉 CAP_SYS_ADMIN 之前安装（未设置 no_new_privs 时需要该能力）
+	if info.Seccomp != nil {
+		if err := installSeccomp(info.Seccomp, info.Capabilities); err != nil {
+			return err
+		}
+	}
+	// bounding 集需在 root 身份下收缩，切换用户后再用 capset 设置剩余的能力
+	if info.ID != "" {
+		if err := dropBoundingCaps(info.Capabilities); err != nil {
+			return err
+		}
+	}
+	if err := switchUser(user); err != nil {
+		return err
+	}
+	if info.ID != "" {
+		return setCapabilities(info.Capabilities)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+const (
+	// run 与 shim 之间的同步管道 fd，shim 启动容器后写回 pid 或错误信息
+	shimSyncEnv = "_GODOCKER_SHIM_SYNC_FD"
+	// 已完成第二次 fork 的标记
+	shimDetachedEnv = "_GODOCKER_SHIM_DETACHED"
+	// child 持有的管道写端，设为 close-on-exec，exec 容器命令时关闭
+	execSyncEnv = "_GODOCKER_EXEC_SYNC_FD"
+)
+
+// 启动容器的 shim 进程并等待容器进程启动，返回容器 pid。
+// shim 经两次 fork 与 run 进程脱离，由 init 收养，run 退出后容器不受影响
+func startShim(info ContainerInfo, cmdArgs []string) (int, error) {
+	selfExe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd := exec.Command(selfExe, append([]string{"shim", info.ID}, cmdArgs...)...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", shimSyncEnv, 3), "GODOCKER_ROOT="+stateRoot())
+	cmd.ExtraFiles = []*os.File{w}
+	// 新会话，脱离当前终端；标准输入输出为 /dev/null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Dir = "/"
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	// 第一层 shim 启动第二层后立即退出
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("启动 shim 失败: %v", err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && line == "" {
+		return 0, fmt.Errorf("shim 未返回容器 pid: %v", err)
+	}
+	line = strings.TrimSpace(line)
+	pid, err := strconv.Atoi(line)
+	if err != nil {
+		return 0, fmt.Errorf("启动容器失败: %s", line)
+	}
+	return pid, nil
+}
+
+// shim: 每个后台容器一个，持有 pty master，等待容器进程退出后写入退出码和结束时间并清理
+func Shim(id string, cmdArgs []string) {
+	syncFd, err := strconv.Atoi(os.Getenv(shimSyncEnv))
+	if err != nil {
+		panic("shim 只能由 run -d 启动")
+	}
+	if os.Getenv(shimDetachedEnv) == "" {
+		// 第一次 fork：启动真正的 shim 后退出，shim 成为孤儿进程，不是会话首进程，不会再获得控制终端
+		selfExe, err := os.Executable()
+		if err != nil {
+			os.Exit(1)
+		}
+		cmd := exec.Command(selfExe, os.Args[1:]...)
+		cmd.Env = append(os.Environ(), shimDetachedEnv+"=1")
+		cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(syncFd), "shim-sync")}
+		if err := cmd.Start(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Unsetenv(shimDetachedEnv)
+	os.Unsetenv(shimSyncEnv)
+	syncPipe := os.NewFile(uintptr(syncFd), "shim-sync")
+	fail := func(err error) {
+		fmt.Fprintf(syncPipe, "%v\n", strings.ReplaceAll(err.Error(), "\n", " "))
+		os.Exit(1)
+	}
+
+	info, err := loadContainerInfo(id)
+	if err != nil {
+		fail(err)
+	}
+	childCmd, afterStart, err := newContainerCmd(info, cmdArgs)
+	if err != nil {
+		fail(err)
+	}
+	execReady, err := addExecSync(childCmd)
+	if err != nil {
+		fail(err)
+	}
+	// 容器输出写入 json-file 日志，同时广播给 attach 的客户端
+	hub := newAttachHub()
+	logger, err := newJSONLogger(containerLogPath(id), info.LogConfig)
+	if err != nil {
+		fail(err)
+	}
+	stdout, stderr := logger.writer("stdout"), logger.writer("stderr")
+	var ptmx *os.File
+	var stdin io.Writer
+	var resize func(*pty.Winsize)
+	if info.Tty {
+		// -t 分配 pty，shim 持有 master 端
+		ptmx, err = pty.Start(childCmd)
+		if err != nil {
+			fail(err)
+		}
+		if info.OpenStdin {
+			stdin = ptmx
+		}
+		resize = func(ws *pty.Winsize) { pty.Setsize(ptmx, ws) }
+	} else {
+		// 没有 -t 时使用管道，-i 时 shim 持有标准输入的写端，否则容器的标准输入为 /dev/null
+		if info.OpenStdin {
+			if stdin, err = childCmd.StdinPipe(); err != nil {
+				fail(err)
+			}
+		}
+		childCmd.Stdout = io.MultiWriter(stdout, hub)
+		childCmd.Stderr = io.MultiWriter(stderr, hub)
+		// 泄漏的后台进程持有输出管道时，容器进程退出后最多再等一秒
+		childCmd.WaitDelay = time.Second
+		if err := childCmd.Start(); err != nil {
+			fail(err)
+		}
+	}
+	outputDone := make(chan struct{})
+	if ptmx != nil {
+		// 持续读取 pty 输出，同时防止缓冲区写满阻塞容器进程
+		go func() {
+			io.Copy(io.MultiWriter(stdout, hub), ptmx)
+			close(outputDone)
+		}()
+	} else {
+		close(outputDone)
+	}
+	if err := afterStart(); err != nil {
+		childCmd.Process.Kill()
+		fail(err)
+	}
+	// 等 child 完成初始化、exec 容器命令后再返回 pid，此后 stop/kill 的信号才会交给容器命令处理
+	execReady()
+	markRunning(&info, childCmd.Process.Pid)
+	info.ShimPid = os.Getpid()
+	saveContainerInfo(info)
+	fmt.Fprintf(syncPipe, "%d\n", info.Pid)
+	syncPipe.Close()
+
+	// attach socket：输出广播给所有 attach 的客户端，输入写回容器的标准输入
+	sockPath := containerSockPath(id)
+	os.Remove(sockPath)
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "监听 attach socket 失败: %v\n", err)
+	} else {
+		go hub.serve(listener, stdin, resize)
+	}
+	childCmd.Wait()
+	waitOutput(outputDone)
+	if listener != nil {
+		listener.Close()
+		os.Remove(sockPath)
+	}
+	hub.closeAll()
+	if ptmx != nil {
+		ptmx.Close()
+	}
+	stdout.Flush()
+	stderr.Flush()
+	logger.Close()
+
+	// 重新读取元数据，期间 stop 等命令可能已更新；rm -f 已删除容器时不再写回
+	latest, err := loadContainerInfo(id)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		info = latest
+	}
+	markExited(&info, exitCode(childCmd.ProcessState))
+	saveContainerInfo(info)
+	cleanupContainer(info, info.AutoRemove)
+	if info.AutoRemove {
+		removeContainerState(id)
+	}
+}
+
+// 给 child 传入一个管道写端，返回的函数阻塞到 child exec 容器命令（或提前退出）为止
+func addExecSync(cmd *exec.Cmd) (func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", execSyncEnv, 2+len(cmd.ExtraFiles)))
+	return func() {
+		w.Close()
+		io.Copy(io.Discard, r)
+		r.Close()
+	}, nil
+}
+
+// child 中调用：把同步管道设为 close-on-exec，exec 容器命令时由内核关闭，shim 随即读到 EOF。
+// 需在 waitIDMap 之后调用，rootless 模式下 child 会先 exec 自己一次。返回管道 fd，没有时为 -1
+func markExecSync() int {
+	fd, err := strconv.Atoi(os.Getenv(execSyncEnv))
+	if err != nil {
+		return -1
+	}
+	syscall.CloseOnExec(fd)
+	os.Unsetenv(execSyncEnv)
+	return fd
+}
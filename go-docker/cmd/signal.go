@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 解析信号，支持 SIGTERM、TERM、term 和数字写法
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("无效的信号: %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("无效的信号: %s", s)
+	}
+	return sig, nil
+}
+
+// 等待进程退出（包括成为僵尸进程），超时返回 false。
+// timeout 为负数时一直等待。调用方不必是父进程：优先用 pidfd 等待，内核不支持时退回轮询 /proc
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err == unix.ESRCH {
+		return true
+	}
+	if err != nil {
+		return pollProcessExit(pid, timeout)
+	}
+	defer unix.Close(fd)
+	deadline := time.Now().Add(timeout)
+	for {
+		ms := -1
+		if timeout >= 0 {
+			ms = int(time.Until(deadline).Milliseconds())
+			if ms < 0 {
+				ms = 0
+			}
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, ms)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return pollProcessExit(pid, time.Until(deadline))
+		}
+		return n > 0
+	}
+}
+
+func pollProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if !processAlive(pid) {
+			return true
+		}
+		if timeout >= 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// 进程存在且不是僵尸进程
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	b, err := readProcStat(pid)
+	return err != nil || b != 'Z'
+}
+
+// /proc/<pid>/stat 中的进程状态字符
+func readProcStat(pid int) (byte, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// comm 字段可能含空格和括号，状态在最后一个 ')' 之后
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 || i+2 >= len(b) {
+		return 0, fmt.Errorf("无法解析 /proc/%d/stat", pid)
+	}
+	return b[i+2], nil
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 属于 IPC namespace 的 sysctl，其余 kernel.* 都是宿主机全局的
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// 返回 sysctl 所属的 namespace（ipc 或 net），不属于任何 namespace 时返回空串
+func sysctlNamespace(key string) string {
+	switch {
+	case ipcSysctls[key], strings.HasPrefix(key, "fs.mqueue."):
+		return "ipc"
+	case strings.HasPrefix(key, "net."):
+		return "net"
+	}
+	return ""
+}
+
+// 解析 --sysctl，格式 key=value，只接受属于某个 namespace 的项，避免修改宿主机全局内核参数
+func parseSysctl(spec string) (string, string, error) {
+	key, value, ok := strings.Cut(spec, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("--sysctl 格式错误，应为 key=value: %s", spec)
+	}
+	if strings.Contains(key, "/") || strings.Contains(key, "..") {
+		return "", "", fmt.Errorf("无效的 sysctl: %s", key)
+	}
+	if sysctlNamespace(key) == "" {
+		return "", "", fmt.Errorf("%s 不属于容器的 namespace，会修改宿主机全局内核参数", key)
+	}
+	return key, value, nil
+}
+
+// 检查 sysctl 所属的 namespace 是否为容器独有，与宿主机或其它容器共用时写入会影响它们
+func checkSysctlNamespace(key, ipcMode string) error {
+	switch sysctlNamespace(key) {
+	case "ipc":
+		if ipcMode != ipcModePrivate {
+			return fmt.Errorf("--ipc=%s 时 IPC namespace 不是容器独有的，不能设置 %s", ipcMode, key)
+		}
+	case "net":
+		// 容器没有独立的 network namespace
+		return fmt.Errorf("容器与宿主机共用网络 namespace，不能设置 %s", key)
+	}
+	return nil
+}
+
+// 写入 /proc/sys，需在 chroot 并挂载 /proc 之后、/proc/sys 设为只读之前调用
+func applySysctls(sysctls map[string]string) error {
+	for key, value := range sysctls {
+		p := filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+		if err := os.WriteFile(p, []byte(value), 0644); err != nil {
+			return fmt.Errorf("设置 sysctl %s=%s 失败: %v", key, value, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 挂载 /sys，需在 chroot 之后调用
+func mountSysfs(readonly bool) {
+	os.MkdirAll("/sys", 0755)
+	if err := syscall.Mount("sysfs", "/sys", "sysfs", sysfsFlags|roFlag(readonly), ""); err != nil {
+		fmt.Printf("child: 挂载 /sys 失败: %v\n", err)
+	}
+}
+
+// 挂载 /sys/fs/cgroup，需在挂载 /proc 之后调用。
+// 配合 CLONE_NEWCGROUP，容器内看到的 cgroup 根就是自己的 cgroup。
+func mountCgroupfs(cgroupMode string, readonly bool) {
+	switch cgroupMode {
+	case cgroupModeV2:
+		if err := syscall.Mount("cgroup2", "/sys/fs/cgroup", "cgroup2", sysfsFlags|roFlag(readonly), ""); err != nil {
+			fmt.Printf("child: 挂载 cgroup2 失败: %v\n", err)
+		}
+	case cgroupModeV1:
+		mountCgroupV1(sysfsFlags, roFlag(readonly))
+	}
+}
+
+const sysfsFlags = uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+
+func roFlag(readonly bool) uintptr {
+	if readonly {
+		return syscall.MS_RDONLY
+	}
+	return 0
+}
+
+// v1 下先在 /sys/fs/cgroup 放一个 tmpfs，再按 /proc/self/cgroup 逐个挂载各层级
+func mountCgroupV1(flags, ro uintptr) {
+	if err := syscall.Mount("tmpfs", "/sys/fs/cgroup", "tmpfs", flags, "mode=755"); err != nil {
+		fmt.Printf("child: 挂载 /sys/fs/cgroup tmpfs 失败: %v\n", err)
+		return
+	}
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		fmt.Printf("child: 读取 /proc/self/cgroup 失败: %v\n", err)
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// 格式: 4:cpu,cpuacct:/ ，层级 0 是 hybrid 模式下的 unified，跳过
+		parts := strings.SplitN(sc.Text(), ":", 3)
+		if len(parts) != 3 || parts[0] == "0" || parts[1] == "" {
+			continue
+		}
+		ctrls := parts[1]
+		opts := ctrls
+		dir := ctrls
+		if name, ok := strings.CutPrefix(ctrls, "name="); ok {
+			opts = "none," + ctrls
+			dir = name
+		}
+		target := filepath.Join("/sys/fs/cgroup", dir)
+		os.MkdirAll(target, 0755)
+		if err := syscall.Mount("cgroup", target, "cgroup", flags|ro, opts); err != nil {
+			fmt.Printf("child: 挂载 cgroup %s 失败: %v\n", ctrls, err)
+			continue
+		}
+		// cpu,cpuacct 这类合并层级，为每个控制器建一个同名链接
+		if strings.Contains(dir, ",") {
+			for _, c := range strings.Split(dir, ",") {
+				os.Symlink(dir, filepath.Join("/sys/fs/cgroup", c))
+			}
+		}
+	}
+	if ro != 0 {
+		syscall.Mount("", "/sys/fs/cgroup", "", syscall.MS_REMOUNT|syscall.MS_BIND|flags|ro, "")
+	}
+}
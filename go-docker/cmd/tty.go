@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// fd 是否为终端
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// 把终端切换到 raw 模式：关闭回显、行缓冲和信号键，按键原样交给容器内的 pty 处理。
+// 返回的函数恢复原来的终端设置，可重复调用；调用方应 defer 它，panic 时也能恢复终端
+func makeRaw(f *os.File) (func(), error) {
+	fd := int(f.Fd())
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { unix.IoctlSetTermios(fd, unix.TCSETS, old) })
+	}, nil
+}
+
+// 宿主机终端当前窗口大小，标准输入不是终端时返回 nil
+func terminalSize() *pty.Winsize {
+	ws, err := pty.GetsizeFull(os.Stdin)
+	if err != nil {
+		return nil
+	}
+	return ws
+}
+
+// 监听 SIGWINCH，终端窗口大小变化时调用 resize。返回的函数停止监听
+func watchResize(resize func(*pty.Winsize)) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				if ws := terminalSize(); ws != nil {
+					resize(ws)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
@@ -1,7 +1,55 @@
 package cmd
 
+import "time"
+
+// 容器状态，与 Docker 相同
+const (
+	statusCreated = "created"
+	statusRunning = "running"
+	statusExited  = "exited"
+)
+
 type ContainerInfo struct {
-	ID     string
-	Rootfs string
-	Pid    int
+	ID         string    `json:"id"`
+	Name       string    `json:"name,omitempty"`
+	Rootfs     string    `json:"rootfs"`
+	Pid        int       `json:"pid"`
+	ShimPid    int       `json:"shim_pid,omitempty"` // 看护容器的进程 pid：后台容器为 shim，前台容器为 run 进程
+	Hostname   string    `json:"hostname,omitempty"`
+	ExtraHosts []string  `json:"extra_hosts,omitempty"`
+	DNS        []string  `json:"dns,omitempty"`
+	CgroupMode string    `json:"cgroup_mode,omitempty"` // v2 或 v1，为空表示未创建 cgroup
+	Resources  resources `json:"resources"`
+	Rootless   bool      `json:"rootless,omitempty"`
+	Layer      string    `json:"layer,omitempty"` // rootless 模式下由 child 解包的镜像层
+	Privileged bool      `json:"privileged,omitempty"`
+	// 容器进程最终的能力集（不带 CAP_ 前缀）
+	Capabilities []string `json:"capabilities"`
+	// 为空表示不启用 seccomp（unconfined 或 --privileged）
+	Seccomp         *seccompProfile          `json:"seccomp,omitempty"`
+	NoNewPrivileges bool                     `json:"no_new_privileges,omitempty"`
+	ReadOnly        bool                     `json:"read_only,omitempty"`
+	Tmpfs           []string                 `json:"tmpfs,omitempty"`
+	ShmSize         int64                    `json:"shm_size,omitempty"`
+	Devices         []deviceMapping          `json:"devices,omitempty"`
+	User            string                   `json:"user,omitempty"`
+	Ulimits         []ulimit                 `json:"ulimits,omitempty"`
+	OOMScoreAdj     int                      `json:"oom_score_adj,omitempty"`
+	Sysctls         map[string]string        `json:"sysctls,omitempty"`
+	IPC             string                   `json:"ipc,omitempty"`
+	TimeOffsets     map[string]time.Duration `json:"time_offsets,omitempty"` // 非空时使用独立的 time namespace
+	LogConfig       logConfig                `json:"log_config"`
+	Tty             bool                     `json:"tty,omitempty"`
+	OpenStdin       bool                     `json:"open_stdin,omitempty"`
+	AutoRemove      bool                     `json:"auto_remove,omitempty"`
+	Env             []string                 `json:"env,omitempty"`
+	Volumes         []volumeMount            `json:"volumes,omitempty"`
+	WorkingDir      string                   `json:"working_dir,omitempty"`
+	Init            bool                     `json:"init,omitempty"`        // --init：child 留作 PID 1，负责转发信号和回收僵尸进程
+	StopSignal      string                   `json:"stop_signal,omitempty"` // 镜像配置的 StopSignal，为空时 stop 使用 SIGTERM
+	Status          string                   `json:"status,omitempty"`      // created、running 或 exited
+	ExitCode        int                      `json:"exit_code"`
+	StartedAt       time.Time                `json:"started_at"`
+	FinishedAt      time.Time                `json:"finished_at"`
+	OOMKilled       bool                     `json:"oom_killed,omitempty"`
 }
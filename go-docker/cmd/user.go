@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 容器进程最终使用的身份
+type execUser struct {
+	Name   string
+	Uid    int
+	Gid    int
+	Groups []int
+	Home   string
+}
+
+// 读取 passwd/group 格式的文件，返回按冒号切分的各行
+func readColonFile(path string) [][]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines [][]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+	return lines
+}
+
+// 按 --user 解析容器内的用户，格式 name|uid[:group|gid]。
+// 需在 chroot 之后调用，用户名和组名在容器自己的 /etc/passwd、/etc/group 中查找；
+// 纯数字的 uid/gid 即使不存在也允许使用，与 Docker 一致。
+func resolveUser(spec string) (execUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	u := execUser{Name: userPart, Home: "/"}
+	if userPart == "" {
+		userPart = "0"
+	}
+	uid, numeric := strconv.Atoi(userPart)
+	found := false
+	for _, f := range readColonFile("/etc/passwd") {
+		// name:password:uid:gid:gecos:home:shell
+		if len(f) < 7 {
+			continue
+		}
+		id, _ := strconv.Atoi(f[2])
+		if f[0] == userPart || (numeric == nil && id == uid) {
+			u.Name, u.Uid, u.Home = f[0], id, f[5]
+			u.Gid, _ = strconv.Atoi(f[3])
+			found = true
+			break
+		}
+	}
+	if !found {
+		if numeric != nil {
+			return u, fmt.Errorf("容器内不存在用户: %s", userPart)
+		}
+		u.Uid = uid
+	}
+	if hasGroup && groupPart != "" {
+		gid, err := strconv.Atoi(groupPart)
+		if err != nil {
+			gid = -1
+			for _, f := range readColonFile("/etc/group") {
+				if len(f) >= 3 && f[0] == groupPart {
+					gid, _ = strconv.Atoi(f[2])
+					break
+				}
+			}
+			if gid < 0 {
+				return u, fmt.Errorf("容器内不存在用户组: %s", groupPart)
+			}
+		}
+		u.Gid = gid
+	}
+	// 附加组：/etc/group 中成员列表包含该用户的组
+	u.Groups = []int{u.Gid}
+	if found {
+		for _, f := range readColonFile("/etc/group") {
+			// name:password:gid:member1,member2
+			if len(f) < 4 {
+				continue
+			}
+			gid, err := strconv.Atoi(f[2])
+			if err != nil || gid == u.Gid {
+				continue
+			}
+			for _, m := range strings.Split(f[3], ",") {
+				if m == u.Name {
+					u.Groups = append(u.Groups, gid)
+					break
+				}
+			}
+		}
+	}
+	return u, nil
+}
+
+// 切换到容器用户。设置 KEEPCAPS 使 setuid 后 permitted 能力集得以保留，
+// 随后由 setCapabilities 重新设置；exec 非 root 用户时这些能力会按内核规则清除。
+func switchUser(u execUser) error {
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("设置 KEEPCAPS 失败: %v", err)
+	}
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		// rootless 只映射一个 id 时禁止 setgroups，以 root 运行时可以忽略
+		if len(u.Groups) > 1 || u.Gid != 0 {
+			return fmt.Errorf("setgroups(%v) 失败: %v", u.Groups, err)
+		}
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("setgid(%d) 失败: %v", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("setuid(%d) 失败: %v", u.Uid, err)
+	}
+	return unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0)
+}
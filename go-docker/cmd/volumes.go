@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// -v 挂载的宿主机目录或文件
+type volumeMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"read_only,omitempty"`
+}
+
+// 解析 -v /host:/container[:ro|rw]，宿主机路径不存在时创建为目录
+func parseVolume(spec string) (volumeMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return volumeMount{}, fmt.Errorf("-v 格式错误，应为 /host:/container[:ro]: %s", spec)
+	}
+	v := volumeMount{Source: parts[0], Destination: parts[1]}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			v.ReadOnly = true
+		case "rw":
+		default:
+			return volumeMount{}, fmt.Errorf("-v 不支持的选项: %s", parts[2])
+		}
+	}
+	if !filepath.IsAbs(v.Source) || !filepath.IsAbs(v.Destination) {
+		return volumeMount{}, fmt.Errorf("-v 需要绝对路径: %s", spec)
+	}
+	v.Source = filepath.Clean(v.Source)
+	v.Destination = filepath.Clean(v.Destination)
+	if v.Destination == "/" {
+		return volumeMount{}, fmt.Errorf("-v 不能挂载到容器根目录: %s", spec)
+	}
+	// 已存在的文件直接 bind，不存在时才创建目录
+	if _, err := os.Stat(v.Source); os.IsNotExist(err) {
+		if err := os.MkdirAll(v.Source, 0755); err != nil {
+			return volumeMount{}, err
+		}
+	} else if err != nil {
+		return volumeMount{}, err
+	}
+	return v, nil
+}
+
+// chroot 前把 -v 指定的宿主机路径 bind 到容器根目录下
+func mountVolumes(rootfs string, volumes []volumeMount) error {
+	for _, v := range volumes {
+		target, err := resolveInRoot(rootfs, v.Destination)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(v.Source)
+		if err != nil {
+			return err
+		}
+		// 挂载点与源路径类型一致：目录建目录，文件建空文件
+		if st.IsDir() {
+			err = os.MkdirAll(target, 0755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("创建挂载点 %s 失败: %v", v.Destination, err)
+		}
+		if err := syscall.Mount(v.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("挂载 %s 到 %s 失败: %v", v.Source, v.Destination, err)
+		}
+		if v.ReadOnly {
+			// user namespace 中重新挂载时必须保留源挂载点被锁定的 nosuid/nodev 等标志
+			var sfs unix.Statfs_t
+			if err := unix.Statfs(target, &sfs); err != nil {
+				return err
+			}
+			locked := uintptr(sfs.Flags) & (unix.ST_NOSUID | unix.ST_NODEV | unix.ST_NOEXEC | unix.ST_NOATIME | unix.ST_NODIRATIME | unix.ST_RELATIME)
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|locked, ""); err != nil {
+				return fmt.Errorf("只读挂载 %s 失败: %v", v.Destination, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 在 rootfs 内解析容器路径：镜像中的符号链接按容器内的路径解析（绝对路径相对 rootfs），
+// ".." 不会越过 rootfs，chroot 之前创建挂载点时不会被符号链接引到宿主机上。
+// 不存在的部分原样保留，由调用方创建
+func resolveInRoot(rootfs, path string) (string, error) {
+	cur := "/"
+	rest := path
+	for links := 0; rest != ""; {
+		var part string
+		part, rest, _ = strings.Cut(rest, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, part)
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("解析 %s 失败: 符号链接层数过多", path)
+		}
+		link, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			cur = "/"
+		}
+		rest = link + "/" + rest
+	}
+	return filepath.Join(rootfs, cur), nil
+}
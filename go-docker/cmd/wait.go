@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// 容器当前状态。以状态文件为准，只有记录为 running 但主进程已不存在时
+// （shim 或前台 run 进程异常退出，没来得及更新状态）才按 exited 处理
+func containerStatus(info ContainerInfo) string {
+	switch info.Status {
+	case statusRunning:
+		if info.Pid <= 0 || !processAlive(info.Pid) {
+			return statusExited
+		}
+	case "":
+		// 旧版本写入的状态文件没有 Status
+		switch {
+		case !info.FinishedAt.IsZero():
+			return statusExited
+		case info.Pid > 0 && processAlive(info.Pid):
+			return statusRunning
+		case info.Pid > 0:
+			return statusExited
+		}
+		return statusCreated
+	}
+	return info.Status
+}
+
+// 阻塞到容器退出，返回退出码。调用方不必是容器的父进程：
+// 后台容器等待 shim 退出（它写完退出状态后才退出），前台容器等待主进程退出
+func waitContainer(id string) (int, error) {
+	for {
+		info, err := loadContainerInfo(id)
+		if err != nil {
+			return -1, fmt.Errorf("容器 %s 已被删除", id)
+		}
+		if info.Status == statusExited || info.Status == "" && !info.FinishedAt.IsZero() {
+			return info.ExitCode, nil
+		}
+		if info.Pid <= 0 {
+			// 容器尚未启动，负责启动它的 run 或 shim 进程已不在时不会再启动
+			if info.ShimPid <= 0 || !processAlive(info.ShimPid) {
+				return -1, fmt.Errorf("容器 %s 未运行", id)
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		pid := info.Pid
+		if info.ShimPid > 0 && processAlive(info.ShimPid) {
+			pid = info.ShimPid
+		}
+		waitProcessExit(pid, -1)
+		// 主进程退出后，shim 或前台 run 进程随即写入退出状态
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) {
+			info, err := loadContainerInfo(id)
+			if err != nil {
+				return -1, fmt.Errorf("容器 %s 已被删除", id)
+			}
+			if info.Status == statusExited || info.Status == "" && !info.FinishedAt.IsZero() {
+				return info.ExitCode, nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return -1, fmt.Errorf("容器 %s 已退出，但没有记录退出码", id)
+	}
+}
+
+// wait: 等待容器退出并依次输出退出码，有容器出错时以 1 退出
+func Wait(args []string) {
+	if len(args) == 0 {
+		panic("wait 需要容器id")
+	}
+	failed := false
+	for _, idPrefix := range args {
+		id, err := FindContainerID(idPrefix)
+		if err == nil {
+			var code int
+			if code, err = waitContainer(id); err == nil {
+				fmt.Println(code)
+				continue
+			}
+		}
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -7,48 +7,49 @@ import (
 )
 
 func main() {
+	// panic 统一转成错误信息和退出码（go-docker 自身出错为 125）
+	defer cmd.HandleExit()
 	if len(os.Args) < 2 {
 		panic("参数不足")
 	}
 	switch os.Args[1] {
 	case "run":
-		// 默认行为为交互式，除非显式指定 --daemon
-		daemon := true
-		runArgs := os.Args[2:]
-		if len(runArgs) == 0 || runArgs[0] != "--daemon" {
-			daemon = false
-		} else {
-			runArgs = runArgs[1:]
-		}
-		cmd.RunWithMode(runArgs, daemon)
+		os.Exit(cmd.Run(os.Args[2:]))
 	case "child":
 		cmd.Child()
+	case "shim":
+		cmd.Shim(os.Args[2], os.Args[3:])
+	case "exec-child":
+		cmd.ExecChild()
 	case "attach-child":
 		cmd.AttachChild()
+	case "userns-rm":
+		cmd.UsernsRemove(os.Args[2])
 	case "ps":
 		cmd.Ps()
 	case "prune":
 		cmd.Prune()
+	case "info":
+		cmd.Info()
+	case "attach":
+		cmd.Attach(os.Args[2:])
+	case "logs":
+		cmd.Logs(os.Args[2:])
 	case "top":
 		if len(os.Args) < 3 {
 			panic("top 需要容器id")
 		}
 		cmd.Top(os.Args[2])
 	case "exec":
-		if len(os.Args) < 4 {
-			panic("exec 需要容器id和命令")
-		}
-		cmd.ExecInContainer(os.Args[2], os.Args[3:])
+		os.Exit(cmd.ExecInContainer(os.Args[2:]))
 	case "stop":
-		if len(os.Args) < 3 {
-			panic("stop 需要容器id")
-		}
-		cmd.StopContainer(os.Args[2])
+		cmd.StopContainer(os.Args[2:])
+	case "kill":
+		cmd.KillContainer(os.Args[2:])
+	case "wait":
+		cmd.Wait(os.Args[2:])
 	case "rm":
-		if len(os.Args) < 3 {
-			panic("rm 需要容器id")
-		}
-		cmd.RmContainer(os.Args[2])
+		cmd.RmContainer(os.Args[2:])
 	default:
 		panic("what?")
 	}